@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"git.sr.ht/~elektito/hodhod/pkg/hodhod"
+)
+
+// Runs the check subcommand, which loads and checks a config file without
+// starting the server. Exits with a non-zero status if there are errors.
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configFile := flags.String("config", "config.json", "Path to config file")
+	flags.Parse(args)
+
+	cfg, err := hodhod.LoadConfig(*configFile)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	errs, warnings := hodhod.CheckConfig(&cfg)
+	for _, err := range errs {
+		fmt.Println("Error:", err)
+	}
+	for _, warning := range warnings {
+		fmt.Println("Warning:", warning)
+	}
+
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: %d warning(s), no errors.\n", *configFile, len(warnings))
+	os.Exit(0)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"git.sr.ht/~elektito/hodhod/pkg/hodhod"
+)
+
+// Runs the fetch subcommand, which sends a request to a Gemini server and
+// prints the response. The body is written to stdout, and everything else to
+// stderr, so the body can be piped somewhere else.
+func runFetch(args []string) {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	certFile := flags.String("cert", "", "Client certificate file")
+	keyFile := flags.String("key", "", "Client certificate key file")
+	sni := flags.String("sni", "", "Server name sent to the server, instead of the URL hostname")
+	connectTo := flags.String("connect-to", "", "Address to connect to, instead of the URL host")
+	expectStatus := flags.Int("expect-status", 0, "Exit with an error if the response status is not this; a single digit only checks the first digit of the status")
+	timeout := flags.Int("timeout", 30, "Timeout for the whole request, in seconds")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hodhod fetch [options] url")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		fail("parsing url", err)
+	}
+	if u.Scheme != "gemini" {
+		fail("parsing url", fmt.Errorf("Invalid URL scheme (%s)", u.Scheme))
+	}
+	if len(u.String()) > hodhod.GeminiMaxRequestSize {
+		fail("parsing url", fmt.Errorf("URL is longer than %d bytes.", hodhod.GeminiMaxRequestSize))
+	}
+
+	addr := *connectTo
+	if addr == "" {
+		addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "1965")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+
+		// Gemini servers mostly use self-signed certificates, so there is
+		// nothing to verify against; the certificate is printed instead.
+		InsecureSkipVerify: true,
+	}
+	if *sni != "" {
+		tlsConfig.ServerName = *sni
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fail("loading client certificate", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: time.Duration(*timeout) * time.Second,
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	if err != nil {
+		fail("connecting", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Duration(*timeout) * time.Second))
+	printTlsDetails(conn)
+
+	_, err = conn.Write([]byte(u.String() + "\r\n"))
+	if err != nil {
+		fail("sending request", err)
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		fail("reading status line", err)
+	}
+
+	header, err := hodhod.ParseHeader(line)
+	if err != nil {
+		fail("reading status line", err)
+	}
+	fmt.Fprintf(os.Stderr, "Status:      %d %s\n", header.Status, header.Meta)
+
+	_, err = io.Copy(os.Stdout, r)
+	if err != nil {
+		fail("reading body", err)
+	}
+
+	if *expectStatus != 0 {
+		status := header.Status
+		if *expectStatus < 10 {
+			status /= 10
+		}
+		if status != *expectStatus {
+			fmt.Fprintf(os.Stderr, "Expected status %d, got %d.\n", *expectStatus, header.Status)
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(0)
+}
+
+func printTlsDetails(conn *tls.Conn) {
+	state := conn.ConnectionState()
+	fmt.Fprintln(os.Stderr, "Connected:  ", conn.RemoteAddr())
+	fmt.Fprintln(os.Stderr, "TLS version:", tls.VersionName(state.Version))
+	fmt.Fprintln(os.Stderr, "Cipher:     ", tls.CipherSuiteName(state.CipherSuite))
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	cert := state.PeerCertificates[0]
+	hostnameMatch := "yes"
+	if err := cert.VerifyHostname(state.ServerName); err != nil {
+		hostnameMatch = "no"
+	}
+	fmt.Fprintln(os.Stderr, "Subject:    ", cert.Subject)
+	fmt.Fprintln(os.Stderr, "Issuer:     ", cert.Issuer)
+	fmt.Fprintln(os.Stderr, "Expires:    ", cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintln(os.Stderr, "Fingerprint:", hodhod.CertFingerprint(cert.Raw))
+	fmt.Fprintln(os.Stderr, "Name match: ", hostnameMatch)
+}
@@ -0,0 +1,369 @@
+package hodhod
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Describes a type of backend, i.e. what backends with this value in their type
+// option accept in the config and how they respond to requests.
+type BackendType struct {
+	// The options accepted by backends of this type, in addition to the ones
+	// accepted by all backends. Any other option in the config file is an
+	// error.
+	Options []string
+
+	// Optional. Decodes a backend of this type as it appears in the config
+	// file, for types that have options not present in the Backend struct. The
+	// returned value is stored in the Options field of the backend.
+	Decode func(raw json.RawMessage) (options interface{}, err error)
+
+	// Optional. Sets the default values of the options of a backend.
+	SetDefaults func(backend *Backend)
+
+	// Optional. Validates the options of a backend, after the defaults are
+	// set.
+	Validate func(backend *Backend, cfg *Config) error
+
+	// Returns the response to a request routed to a backend of this type.
+	// unmatched is the part of the request path not matched by the route.
+	NewResponse func(backend *Backend, unmatched string, req Request, cfg *Config) Response
+}
+
+// options accepted by all backend types
+var commonBackendOptions = []string{"name", "type", "max_response_size"}
+
+// Backend types, keyed by the name used in the type option.
+var backendTypes = struct {
+	sync.Mutex
+	byName map[string]BackendType
+}{
+	byName: map[string]BackendType{},
+}
+
+// Registers a backend type, so that backends can use it. Types should be
+// registered before the config using them is loaded. Registering a type with
+// the same name as an existing one replaces it.
+func RegisterBackendType(name string, backendType BackendType) {
+	backendTypes.Lock()
+	defer backendTypes.Unlock()
+
+	backendTypes.byName[name] = backendType
+}
+
+func lookupBackendType(name string) (backendType BackendType, ok bool) {
+	backendTypes.Lock()
+	defer backendTypes.Unlock()
+
+	backendType, ok = backendTypes.byName[name]
+	return
+}
+
+func backendTypeNames() (names []string) {
+	backendTypes.Lock()
+	defer backendTypes.Unlock()
+
+	for name := range backendTypes.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Makes sure the type of each backend exists, and that backends loaded from the
+// config file have no options unknown to their type. Also runs the decoder of
+// the type, if any.
+func decodeBackends(cfg *Config) (err error) {
+	for i, backend := range cfg.Backends {
+		backendType, ok := lookupBackendType(backend.Type)
+		if !ok {
+			return fmt.Errorf("Invalid backend type '%s' for backend '%s'; valid values are: %s", backend.Type, backend.Name, strings.Join(backendTypeNames(), ", "))
+		}
+
+		// backends built programmatically have nothing to check
+		if backend.raw == nil {
+			continue
+		}
+
+		var options map[string]json.RawMessage
+		err = json.Unmarshal(backend.raw, &options)
+		if err != nil {
+			return
+		}
+
+		for option := range options {
+			if !contains(commonBackendOptions, option) && !contains(backendType.Options, option) {
+				return fmt.Errorf("Unknown option '%s' for %s backend '%s'.", option, backend.Type, backend.Name)
+			}
+		}
+
+		if backendType.Decode != nil {
+			cfg.Backends[i].Options, err = backendType.Decode(backend.raw)
+			if err != nil {
+				return fmt.Errorf("Error decoding backend '%s': %s", backend.Name, err)
+			}
+		}
+	}
+
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+var staticOptions = []string{
+	"location", "file_ext", "follow_symlinks", "allow_dotfiles", "lang",
+	"charset", "dir_params", "meta_file", "not_found_page", "error_page",
+}
+
+var cgiOptions = []string{
+	"stderr", "stderr_file", "stderr_limit", "env", "inherit_env", "user",
+	"group", "working_dir", "chroot", "rlimits", "streaming", "cgi_mode",
+	"cache", "not_found_page", "error_page",
+}
+
+func concat(lists ...[]string) (result []string) {
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+
+	return
+}
+
+func setStaticDefaults(backend *Backend) {
+	if backend.FileExt == "" {
+		backend.FileExt = "strip"
+	}
+
+	if backend.FollowSymlinks == "" {
+		backend.FollowSymlinks = "within"
+	}
+
+	if backend.MetaFile == "" {
+		backend.MetaFile = ".meta"
+	}
+
+	// symlink checks compare resolved paths against the location, so it needs
+	// to be absolute. userdir locations are templates, and are only resolved
+	// when serving a request.
+	if backend.Type != "userdir" && backend.Location != "" {
+		location, err := filepath.Abs(backend.Location)
+		if err == nil {
+			backend.Location = location
+		}
+	}
+}
+
+func setCgiDefaults(backend *Backend) {
+	if backend.Stderr == "" {
+		backend.Stderr = "discard"
+	}
+	if backend.StderrLimit == 0 {
+		backend.StderrLimit = 64 * 1024
+	}
+	if backend.CgiMode == "" {
+		backend.CgiMode = "nph"
+	}
+}
+
+func validateStaticOptions(backend *Backend, cfg *Config) error {
+	if backend.Type != "userdir" && backend.Location == "" {
+		return fmt.Errorf("Location missing for %s backend.", backend.Type)
+	}
+	if backend.FileExt != "strip" && backend.FileExt != "include" {
+		return fmt.Errorf("Invalid value '%s' for file_ext option; valid values are 'strip' and 'include'.", backend.FileExt)
+	}
+	switch backend.FollowSymlinks {
+	case "never":
+	case "within":
+	case "always":
+	default:
+		return fmt.Errorf("Invalid value '%s' for follow_symlinks option; valid values are 'never', 'within' and 'always'.", backend.FollowSymlinks)
+	}
+	if strings.ContainsAny(backend.MetaFile, "/\\") {
+		return fmt.Errorf("Invalid meta_file '%s'; it should be a plain file name.", backend.MetaFile)
+	}
+	for _, params := range backend.DirParams {
+		if params.Dir == "" {
+			return fmt.Errorf("Empty dir in dir_params of backend '%s'.", backend.Name)
+		}
+	}
+
+	return nil
+}
+
+func validateCgiOptions(backend *Backend, cfg *Config) error {
+	switch backend.Stderr {
+	case "discard":
+	case "log":
+	case "onerror":
+	default:
+		return fmt.Errorf("Invalid value '%s' for stderr option; valid values are 'discard', 'log' and 'onerror'.", backend.Stderr)
+	}
+	if backend.StderrLimit < 0 {
+		return fmt.Errorf("Invalid value %d for stderr_limit option.", backend.StderrLimit)
+	}
+	if backend.CgiMode != "nph" && backend.CgiMode != "parsed" {
+		return fmt.Errorf("Invalid value '%s' for cgi_mode option; valid values are 'nph' and 'parsed'.", backend.CgiMode)
+	}
+	if backend.Cache.Ttl < 0 || backend.Cache.MaxSize < 0 {
+		return fmt.Errorf("Invalid cache options for backend '%s'; ttl and max_size should not be negative.", backend.Name)
+	}
+	if backend.Cache.MaxSize > 0 && backend.Streaming {
+		return fmt.Errorf("Backend '%s' cannot both cache and stream responses.", backend.Name)
+	}
+	if backend.Cache.Dir != "" {
+		info, err := os.Stat(backend.Cache.Dir)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("Cache directory for backend '%s' does not exist: %s", backend.Name, backend.Cache.Dir)
+		}
+
+		// leftover cache files are removed when the cache is created, which
+		// would remove the files of any other cache in the same directory.
+		for _, other := range cfg.Backends {
+			if other.Name != backend.Name && other.Cache.Dir != "" && filepath.Clean(other.Cache.Dir) == filepath.Clean(backend.Cache.Dir) {
+				return fmt.Errorf("Backends '%s' and '%s' cannot use the same cache directory.", backend.Name, other.Name)
+			}
+		}
+	}
+	if backend.needsSandbox() && !cgiSandboxSupported {
+		return fmt.Errorf("Backend '%s' uses CGI sandboxing options, which are not supported on this platform.", backend.Name)
+	}
+	if backend.User != "" {
+		if _, err := user.Lookup(backend.User); err != nil {
+			return fmt.Errorf("Invalid user for backend '%s': %s", backend.Name, err)
+		}
+	}
+	if backend.Group != "" {
+		if _, err := user.LookupGroup(backend.Group); err != nil {
+			return fmt.Errorf("Invalid group for backend '%s': %s", backend.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	RegisterBackendType("static", BackendType{
+		Options:     staticOptions,
+		SetDefaults: setStaticDefaults,
+		Validate:    validateStaticOptions,
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			return ApplyErrorPages(NewFileResp(backend, unmatched, req, cfg), backend, &req, cfg)
+		},
+	})
+
+	RegisterBackendType("userdir", BackendType{
+		Options: concat(staticOptions, cgiOptions, []string{"allowed_users", "cgi", "cgi_exts"}),
+		SetDefaults: func(backend *Backend) {
+			if backend.Location == "" {
+				backend.Location = "{home}/public_gemini"
+			}
+			if backend.CgiExts == nil {
+				backend.CgiExts = []string{".cgi"}
+			}
+			setStaticDefaults(backend)
+			setCgiDefaults(backend)
+		},
+		Validate: func(backend *Backend, cfg *Config) error {
+			if !strings.Contains(backend.Location, "{user}") && !strings.Contains(backend.Location, "{home}") {
+				return fmt.Errorf("Location for userdir backend must contain either {user} or {home}.")
+			}
+			// without root privileges, user scripts would run as the server
+			// user, which would give every user the server's privileges.
+			if backend.Cgi && backend.User == "" && os.Geteuid() != 0 {
+				return fmt.Errorf("Backend '%s' runs user scripts, which needs Hodhod to be running as root, or the user option to be set.", backend.Name)
+			}
+			err := validateStaticOptions(backend, cfg)
+			if err != nil {
+				return err
+			}
+			return validateCgiOptions(backend, cfg)
+		},
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			return ApplyErrorPages(NewUserDirResp(backend, unmatched, req, cfg), backend, &req, cfg)
+		},
+	})
+
+	RegisterBackendType("cgi", BackendType{
+		Options:     concat(cgiOptions, []string{"script"}),
+		SetDefaults: setCgiDefaults,
+		Validate: func(backend *Backend, cfg *Config) error {
+			if backend.Script == "" {
+				return fmt.Errorf("Script missing for cgi backend.")
+			}
+			return validateCgiOptions(backend, cfg)
+		},
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			resp := NewCgiResp(req, backend, NewCgiScript(backend, &req, unmatched), cfg)
+			return ApplyErrorPages(resp, backend, &req, cfg)
+		},
+	})
+
+	RegisterBackendType("cgi_dir", BackendType{
+		Options: concat(staticOptions, cgiOptions, []string{"cgi_exts"}),
+		SetDefaults: func(backend *Backend) {
+			setStaticDefaults(backend)
+			setCgiDefaults(backend)
+		},
+		Validate: func(backend *Backend, cfg *Config) error {
+			err := validateStaticOptions(backend, cfg)
+			if err != nil {
+				return err
+			}
+			return validateCgiOptions(backend, cfg)
+		},
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			return ApplyErrorPages(NewCgiDirResp(backend, unmatched, req, cfg), backend, &req, cfg)
+		},
+	})
+
+	RegisterBackendType("status", BackendType{
+		Options: []string{"status", "meta"},
+		Validate: func(backend *Backend, cfg *Config) error {
+			if backend.Status < 10 || backend.Status > 69 || backend.Status/10 == 2 {
+				return fmt.Errorf("Invalid status %d for status backend '%s'; it should be a two-digit non-success status code.", backend.Status, backend.Name)
+			}
+			if (backend.Status/10 == 1 || backend.Status/10 == 3) && backend.Meta == "" {
+				return fmt.Errorf("Status backend '%s' needs a meta for status %d.", backend.Name, backend.Status)
+			}
+			return nil
+		},
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			// status backends always respond exactly as configured, so error
+			// pages are not applied.
+			return NewStatusResp(backend.Status, backend.Meta)
+		},
+	})
+
+	RegisterBackendType("handler", BackendType{
+		Options: []string{"handler", "streaming", "not_found_page", "error_page"},
+		SetDefaults: func(backend *Backend) {
+			if backend.Handler == "" {
+				backend.Handler = backend.Name
+			}
+		},
+		Validate: func(backend *Backend, cfg *Config) error {
+			if lookupHandler(backend.Handler) == nil {
+				return fmt.Errorf("No handler registered with name '%s' for backend '%s'.", backend.Handler, backend.Name)
+			}
+			return nil
+		},
+		NewResponse: func(backend *Backend, unmatched string, req Request, cfg *Config) Response {
+			return ApplyErrorPages(NewHandlerResp(backend, cfg), backend, &req, cfg)
+		},
+	})
+}
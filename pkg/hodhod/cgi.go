@@ -1,37 +1,98 @@
 package hodhod
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type CgiResponse struct {
 	cmd          *exec.Cmd
 	stdin        io.WriteCloser
-	stdout       io.Reader
+	stdout       *bufio.Reader
+	stdoutFile   *os.File
 	stderr       io.Reader
 	cancelScript func()
+
+	// closed when the script has exited; result is set before that, and is
+	// nil if the script was successful.
+	done   chan struct{}
+	result error
+
+	// if the script fails before producing a valid header, this is set to an
+	// error response, and is sent instead.
+	failureResp Response
+	makeFailure func(err error) Response
+
+	// in streaming mode, the script is killed if it does not produce any
+	// output for idleTimeout, instead of having a limit on its total run time.
+	streaming   bool
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	// in parsed mode, the script outputs CGI-style headers, which are
+	// converted to a Gemini header.
+	parsed      bool
+	defaultType string
+
+	// if the response can be cached, the output is recorded here until the
+	// script exits, and then stored in cache for cacheTtl seconds.
+	cache    *cgiCache
+	cacheKey string
+	cacheTtl int
+	recorded []byte
 }
 
 type CgiError struct {
 	ExitCode int
+	TimedOut bool
+	Canceled bool
+	Err      error
 }
 
 func (e CgiError) Error() string {
-	if e.ExitCode != 0 {
+	switch {
+	case e.TimedOut:
+		return "CGI script timed out."
+	case e.Canceled:
+		return "CGI script was killed because the request was closed."
+	case e.ExitCode > 0:
 		return fmt.Sprintf("CGI script exited with non-zero exit code %d.", e.ExitCode)
+	case e.Err != nil:
+		return fmt.Sprintf("Error running CGI script: %s", e.Err)
 	}
 
 	return "Error running CGI script"
 }
 
-func cgiError(exitCode int) CgiError {
-	return CgiError{
-		ExitCode: exitCode,
+// Converts the error returned from waiting for the script to a CgiError, or nil
+// if there was no error. idleTimedOut should be true if the script was killed
+// because of the streaming idle timeout.
+func cgiError(err error, ctx context.Context, idleTimedOut bool) error {
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case idleTimedOut || ctx.Err() == context.DeadlineExceeded:
+		return CgiError{TimedOut: true, Err: err}
+	case ctx.Err() == context.Canceled:
+		return CgiError{Canceled: true, Err: err}
+	case errors.As(err, &exitErr):
+		return CgiError{ExitCode: exitErr.ExitCode(), Err: err}
+	default:
+		return CgiError{Err: err}
 	}
 }
 
@@ -42,64 +103,354 @@ func (resp *CgiResponse) Backend() string {
 func (resp *CgiResponse) Init(req *Request) (err error) {
 	reqLine := []byte(req.Url.String())
 	reqLine = append(reqLine, '\r', '\n')
-	_, err = resp.stdin.Write(reqLine)
+
+	// scripts are free to not read their input at all, and exit before we
+	// are done writing it, so failing to write is not an error.
+	resp.stdin.Write(reqLine)
 	resp.stdin.Close()
 	return
 }
 
-func (resp *CgiResponse) Read(p []byte) (n int, err error) {
-	if resp.cmd.ProcessState != nil {
-		if resp.cmd.ProcessState.ExitCode() != 0 {
-			err = cgiError(resp.cmd.ProcessState.ExitCode())
-			return
+func (resp *CgiResponse) Send(w ResponseWriter) (err error) {
+	header, err := resp.readHeader()
+	if err != nil {
+		return resp.fail(err, w)
+	}
+
+	resp.resetIdleTimer()
+	resp.record([]byte(header.String()))
+	w.WriteHeader(header.Status, header.Meta)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.stdout.Read(buf)
+		if n > 0 {
+			resp.resetIdleTimer()
+			resp.record(buf[:n])
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return
+			}
 		}
 
-		err = io.EOF
-		return
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+	}
+
+	// the stdout pipe is only closed after the script has exited, so by now
+	// we should know the result.
+	<-resp.done
+	if resp.result != nil {
+		// it's too late to send a proper status; returning an error aborts the
+		// connection, so that the client knows the response is incomplete.
+		return resp.result
 	}
 
-	n, err = resp.stdout.Read(p)
+	resp.storeInCache()
 	return
 }
 
-func (resp *CgiResponse) Close() {
-	if resp.cmd.ProcessState == nil {
+// Reads the header from the output of the script, converting it to a Gemini
+// header in parsed mode.
+func (resp *CgiResponse) readHeader() (header Header, err error) {
+	if !resp.parsed {
+		return readHeader(resp.stdout)
+	}
+
+	header, maxAge, err := parseCgiHeaders(resp.stdout, resp.defaultType)
+	if err == nil && maxAge >= 0 {
+		resp.cacheTtl = maxAge
+	}
+	return
+}
+
+func (resp *CgiResponse) resetIdleTimer() {
+	if resp.idleTimer != nil {
+		resp.idleTimer.Reset(resp.idleTimeout)
+	}
+}
+
+// Sends an error response instead of the output of the script, after making
+// sure the script has exited. This can only be done before the header is sent.
+// If the script had already failed on its own, that takes precedence over the
+// given error.
+func (resp *CgiResponse) fail(err error, w ResponseWriter) error {
+	select {
+	case <-resp.done:
+		if resp.result != nil {
+			err = resp.result
+		}
+	default:
 		resp.cancelScript()
+		<-resp.done
 	}
+
+	resp.failureResp = resp.makeFailure(err)
+	return resp.failureResp.Send(w)
 }
 
-func NewCgiResp(req Request, scriptPath string, cfg *Config) (resp Response) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(cfg.CgiTimeout)*time.Second)
-	cmd := exec.CommandContext(ctx, scriptPath)
+// Records some output of the script to be cached, unless the output has gotten
+// too large for the cache.
+func (resp *CgiResponse) record(output []byte) {
+	if resp.cache == nil || resp.cacheTtl == 0 {
+		return
+	}
 
-	rStdin, wStdin := io.Pipe()
-	rStdout, wStdout := io.Pipe()
-	rStderr, wStderr := io.Pipe()
+	if int64(len(resp.recorded)+len(output)) > resp.cache.maxSize {
+		resp.cache = nil
+		resp.recorded = nil
+		return
+	}
+
+	resp.recorded = append(resp.recorded, output...)
+}
+
+// Stores the recorded output in cache, after the script has exited
+// successfully. Only success and redirect responses are cached, since input
+// prompts, failures and certificate requests depend on the request in ways the
+// cache key does not capture.
+func (resp *CgiResponse) storeInCache() {
+	if resp.cache == nil || resp.cacheTtl == 0 || len(resp.recorded) == 0 {
+		return
+	}
+
+	if resp.recorded[0] == '2' || resp.recorded[0] == '3' {
+		resp.cache.put(resp.cacheKey, resp.recorded, resp.cacheTtl)
+	}
+
+	resp.cache = nil
+	resp.recorded = nil
+}
+
+func (resp *CgiResponse) Streaming() bool {
+	return resp.streaming
+}
+
+func (resp *CgiResponse) Close() {
+	// this is harmless if the script has already exited, and releases the
+	// context resources either way.
+	resp.cancelScript()
+	resp.stdoutFile.Close()
+
+	if resp.idleTimer != nil {
+		resp.idleTimer.Stop()
+	}
+
+	if resp.failureResp != nil {
+		resp.failureResp.Close()
+	}
+}
+
+// Describes the CGI script handling a request.
+type CgiScript struct {
+	// Path of the script file
+	Path string
+
+	// The part of the URL path leading to the script
+	Name string
+
+	// The part of the URL path after the script name
+	PathInfo string
+
+	// The directory the script is served from
+	DocumentRoot string
+}
+
+// Splits the path of a request URL into the part leading to the script and the
+// part after it, given the unmatched part of the path as returned by
+// GetBackendByUrl. Since the unmatched part comes from the normalized URL, its
+// trailing slash might be different from the request URL.
+func splitScriptPath(urlPath string, unmatched string) (scriptName string, pathInfo string) {
+	rest := strings.TrimSuffix(unmatched, "/")
+	trimmed := strings.TrimSuffix(urlPath, "/")
+	if rest == "" || !strings.HasSuffix(trimmed, "/"+rest) {
+		return trimmed, urlPath[len(trimmed):]
+	}
+
+	scriptName = trimmed[:len(trimmed)-len(rest)-1]
+	pathInfo = urlPath[len(scriptName):]
+	return
+}
+
+// Returns the CgiScript for a request routed to the given cgi backend.
+func NewCgiScript(backend *Backend, req *Request, unmatched string) CgiScript {
+	scriptName, pathInfo := splitScriptPath(req.Url.Path, unmatched)
+	return CgiScript{
+		Path:         backend.Script,
+		Name:         scriptName,
+		PathInfo:     pathInfo,
+		DocumentRoot: filepath.Dir(backend.Script),
+	}
+}
+
+// Returns the environment variables passed to a CGI script.
+func cgiEnv(req *Request, backend *Backend, script CgiScript, cfg *Config) (env []string) {
+	remoteHost, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteHost = req.RemoteAddr
+	}
 
-	cmd.Env = []string{
+	_, serverPort, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		serverPort = "1965"
+	}
+
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = "/usr/local/bin:/usr/bin:/bin"
+	}
+
+	env = []string{
 		"GATEWAY_INTERFACE=CGI/1.1",
 		"SERVER_PROTOCOL=GEMINI",
 		"REQUEST_METHOD=",
 		"SERVER_SOFTWARE=hodhod",
+		fmt.Sprintf("PATH=%s", path),
 		fmt.Sprintf("GEMINI_URL=%s", req.Url.String()),
 		fmt.Sprintf("GEMINI_URL_PATH=%s", req.Url.Path),
-		fmt.Sprintf("PATH_INFO=%s", req.Url.Path),
+		fmt.Sprintf("GEMINI_DOCUMENT_ROOT=%s", script.DocumentRoot),
+		fmt.Sprintf("DOCUMENT_ROOT=%s", script.DocumentRoot),
+		fmt.Sprintf("PATH_INFO=%s", script.PathInfo),
 		fmt.Sprintf("QUERY_STRING=%s", req.Url.RawQuery),
-		fmt.Sprintf("SCRIPT_NAME=%s", scriptPath),
+		fmt.Sprintf("SCRIPT_NAME=%s", script.Name),
+		fmt.Sprintf("SCRIPT_FILENAME=%s", script.Path),
 		fmt.Sprintf("SERVER_NAME=%s", req.Url.Hostname()),
-		fmt.Sprintf("REMOTE_ADDR=%s", req.RemoteAddr),
-		fmt.Sprintf("REMOTE_HOST=%s", req.RemoteAddr),
+		fmt.Sprintf("SERVER_PORT=%s", serverPort),
+		fmt.Sprintf("REMOTE_ADDR=%s", remoteHost),
+		fmt.Sprintf("REMOTE_HOST=%s", remoteHost),
+		fmt.Sprintf("REMOTE_PORT=%s", remotePort),
+	}
+
+	if script.PathInfo != "" {
+		env = append(env, fmt.Sprintf("PATH_TRANSLATED=%s", filepath.Join(script.DocumentRoot, filepath.FromSlash(script.PathInfo))))
+	}
+
+	if req.ClientCert != nil {
+		env = append(env,
+			"AUTH_TYPE=Certificate",
+			fmt.Sprintf("REMOTE_USER=%s", req.ClientCert.Subject.CommonName),
+			fmt.Sprintf("TLS_CLIENT_HASH=%s", CertFingerprint(req.ClientCert.Raw)),
+		)
+	}
+
+	for _, name := range backend.InheritEnv {
+		value, ok := os.LookupEnv(name)
+		if ok {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+
+	// the extra variables come last, so that they can override anything set
+	// above.
+	for name, value := range backend.Env {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+
+	return
+}
+
+// The two ends of a pipe.
+type pipe struct {
+	r *os.File
+	w *os.File
+}
+
+// Creates the pipes for the standard input, output and error of a CGI script.
+// These are OS pipes, instead of ones fed by goroutines copying the data, so
+// that waiting for the script returns as soon as it exits, even if a slow
+// client has not read all of its output yet.
+func newCgiPipes() (stdin pipe, stdout pipe, stderr pipe, err error) {
+	var pipes []pipe
+	for i := 0; i < 3; i++ {
+		var p pipe
+		p.r, p.w, err = os.Pipe()
+		if err != nil {
+			for _, p := range pipes {
+				p.r.Close()
+				p.w.Close()
+			}
+			return
+		}
+		pipes = append(pipes, p)
 	}
-	cmd.Stdin = rStdin
-	cmd.Stdout = wStdout
-	cmd.Stderr = wStderr
-	cmd.WaitDelay = 5 * time.Second
 
-	err := cmd.Start()
+	return pipes[0], pipes[1], pipes[2], nil
+}
+
+func NewCgiResp(req Request, backend *Backend, script CgiScript, cfg *Config) (resp Response) {
+	// without per_cert, the response to a request with a certificate might
+	// still depend on it, so it is never cached.
+	cache := getCgiCache(backend)
+	if req.ClientCert != nil && !backend.Cache.PerCert {
+		cache = nil
+	}
+
+	cacheKey := ""
+	if cache != nil {
+		cacheKey = cgiCacheKey(backend, &req)
+		resp = cache.get(cacheKey)
+		if resp != nil {
+			return
+		}
+	}
+
+	timeout := time.Duration(cfg.CgiTimeout) * time.Second
+
+	var ctx context.Context
+	var cancelFunc context.CancelFunc
+	var idleTimer *time.Timer
+	var idleTimedOut atomic.Bool
+	if backend.Streaming {
+		ctx, cancelFunc = context.WithCancel(req.Context())
+	} else {
+		ctx, cancelFunc = context.WithTimeout(req.Context(), timeout)
+	}
+
+	cmd := exec.CommandContext(ctx, script.Path)
+	if backend.needsSandbox() {
+		path, args, err := cgiExecCommand(backend, &script)
+		if err != nil {
+			log.Println("Error preparing CGI sandbox:", err)
+			cancelFunc()
+			return NewStatusResp(42, "CGI Error")
+		}
+		cmd.Path = path
+		cmd.Args = args
+	}
+	if backend.Chroot == "" {
+		cmd.Dir = backend.WorkingDir
+	}
+	setProcessGroup(cmd)
+
+	stdin, stdout, stderr, err := newCgiPipes()
+	if err != nil {
+		log.Println("Error creating pipes for CGI script:", err)
+		cancelFunc()
+		return NewStatusResp(42, "CGI Error")
+	}
+
+	cmd.Env = cgiEnv(&req, backend, script, cfg)
+	cmd.Stdin = stdin.r
+	cmd.Stdout = stdout.w
+	cmd.Stderr = stderr.w
+
+	err = cmd.Start()
+
+	// the script has its own copies of these now
+	stdin.r.Close()
+	stdout.w.Close()
+	stderr.w.Close()
+
 	if err != nil {
 		log.Println("Error running CGI script:", err)
+		stdin.w.Close()
+		stdout.r.Close()
+		stderr.r.Close()
 		resp = &ErrorResponse{
-			StatusCode: 43,
+			StatusCode: 42,
 			Meta:       "CGI Error",
 		}
 
@@ -107,46 +458,76 @@ func NewCgiResp(req Request, scriptPath string, cfg *Config) (resp Response) {
 		return
 	}
 
+	// the idle timer is only started once the script is running, so that it
+	// does not need to be stopped on the error paths above.
+	if backend.Streaming {
+		idleTimer = time.AfterFunc(timeout, func() {
+			idleTimedOut.Store(true)
+			cancelFunc()
+		})
+	}
+
+	rStderr, wStderr := io.Pipe()
+	go handleCgiStderr(rStderr, backend, script.Path, &req)
+
+	cgiResp := &CgiResponse{
+		cmd:          cmd,
+		stdin:        stdin.w,
+		stdout:       bufio.NewReaderSize(stdout.r, 4096),
+		stdoutFile:   stdout.r,
+		stderr:       rStderr,
+		cancelScript: cancelFunc,
+		done:         make(chan struct{}),
+		streaming:    backend.Streaming,
+		idleTimeout:  timeout,
+		idleTimer:    idleTimer,
+		parsed:       backend.CgiMode == "parsed",
+		defaultType:  cfg.ContentType.Default,
+		cache:        cache,
+		cacheKey:     cacheKey,
+		cacheTtl:     backend.Cache.Ttl,
+		makeFailure: func(err error) Response {
+			meta := "CGI Error"
+			if cgiErr, ok := err.(CgiError); ok && cgiErr.TimedOut {
+				meta = "CGI Timeout"
+			}
+			log.Printf("CGI script (%s) failed before sending a valid header (id=%s): %s\n", script.Path, req.Id, err)
+			return ApplyErrorPages(NewStatusResp(42, meta), backend, &req, cfg)
+		},
+	}
+
 	go func() {
-		// This function can be useful for debugging CGI scripts. We can read
-		// the stderr here and log it.
-		//
-		// TODO: We could have an option to log these (maybe to a separate file,
-		// and/or when there was a CGI error)
-		//
-		// stderr, err := io.ReadAll(rStderr)
-		// if err == nil {
-		//    log.Println("CGI stderr:", string(stderr))
-		// } else {
-		// 	  log.Println("Error reading CGI stderr:", err)
-		// }
-
-		io.Copy(io.Discard, rStderr)
+		err := cgiError(cmd.Wait(), ctx, idleTimedOut.Load())
+
+		// whatever the script has left running could keep its output open
+		// indefinitely.
+		killProcessGroup(cmd)
+
+		cgiResp.result = err
+		close(cgiResp.done)
+
+		if err != nil {
+			log.Printf("CGI script (%s) failed (id=%s): %s\n", script.Path, req.Id, err)
+		}
 	}()
 
 	go func() {
-		err := cmd.Wait()
-		if err != nil {
-			log.Printf("CGI script (%s) timeout (error: %s)\n", scriptPath, err)
-			rStdin.CloseWithError(fmt.Errorf("CGI timeout"))
-			wStdout.CloseWithError(fmt.Errorf("CGI timeout"))
-			wStderr.CloseWithError(fmt.Errorf("CGI timeout"))
+		io.Copy(wStderr, stderr.r)
+		stderr.r.Close()
+
+		// the error signals the failure to the stderr handler
+		<-cgiResp.done
+		if cgiResp.result != nil {
+			wStderr.CloseWithError(cgiResp.result)
 		} else {
-			rStdin.Close()
-			wStdout.Close()
 			wStderr.Close()
 		}
 	}()
 
-	resp = &CgiResponse{
-		cmd:          cmd,
-		stdin:        wStdin,
-		stdout:       rStdout,
-		stderr:       rStderr,
-		cancelScript: cancelFunc,
-	}
+	resp = cgiResp
 	return
 }
 
 var _ Response = (*CgiResponse)(nil)
+var _ StreamingResponse = (*CgiResponse)(nil)
 var _ error = (*CgiError)(nil)
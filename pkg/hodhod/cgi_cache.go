@@ -0,0 +1,225 @@
+package hodhod
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// prefix of the names of the files stored in a cache directory
+const cgiCacheFilePrefix = "cgi-cache-"
+
+type cgiCacheEntry struct {
+	key     string
+	expires time.Time
+	size    int64
+
+	// the whole response, including the status line, when stored in memory
+	data []byte
+
+	// the file containing the response, when stored on disk
+	path string
+}
+
+// The cached responses of a CGI backend, with the least recently used ones
+// evicted when the total size goes over the max_size option of the backend.
+type cgiCache struct {
+	sync.Mutex
+	maxSize int64
+	dir     string
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+// CGI response caches, keyed by backend name.
+var cgiCaches = struct {
+	sync.Mutex
+	caches map[string]*cgiCache
+}{
+	caches: map[string]*cgiCache{},
+}
+
+// Returns the response cache of the given backend, or nil if caching is not
+// enabled for it.
+func getCgiCache(backend *Backend) *cgiCache {
+	if backend.Cache.MaxSize == 0 {
+		return nil
+	}
+
+	cgiCaches.Lock()
+	defer cgiCaches.Unlock()
+
+	cache, ok := cgiCaches.caches[backend.Name]
+	if ok {
+		return cache
+	}
+
+	cache = &cgiCache{
+		maxSize: backend.Cache.MaxSize,
+		dir:     backend.Cache.Dir,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	if cache.dir != "" {
+		// files left over from a previous run are not in the index, so they
+		// would never be used or cleaned up otherwise.
+		leftovers, _ := filepath.Glob(filepath.Join(cache.dir, cgiCacheFilePrefix+"*"))
+		for _, leftover := range leftovers {
+			os.Remove(leftover)
+		}
+	}
+
+	cgiCaches.caches[backend.Name] = cache
+	return cache
+}
+
+// Returns the key a response to the given request is cached under.
+func cgiCacheKey(backend *Backend, req *Request) string {
+	key := req.Url.String()
+	if backend.Cache.PerCert {
+		key += "\x00"
+		if req.ClientCert != nil {
+			key += CertFingerprint(req.ClientCert.Raw)
+		}
+	}
+
+	return key
+}
+
+func (c *cgiCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cgiCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if entry.path != "" {
+		os.Remove(entry.path)
+	}
+}
+
+// Returns the cached response for the given key, or nil if there is none or it
+// has expired.
+func (c *cgiCache) get(key string) Response {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*cgiCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.removeElement(elem)
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	if entry.path == "" {
+		return &CachedCgiResponse{
+			body: bytes.NewReader(entry.data),
+		}
+	}
+
+	// the file stays readable even if the entry is evicted before we are done
+	// with it.
+	f, err := os.Open(entry.path)
+	if err != nil {
+		log.Println("Error reading cached CGI response:", err)
+		c.removeElement(elem)
+		return nil
+	}
+
+	return &CachedCgiResponse{
+		body: f,
+		file: f,
+	}
+}
+
+// Stores a response in the cache for the given number of seconds.
+func (c *cgiCache) put(key string, data []byte, ttl int) {
+	entry := &cgiCacheEntry{
+		key:     key,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+		size:    int64(len(data)),
+	}
+
+	if c.dir == "" {
+		entry.data = data
+	} else {
+		sum := sha256.Sum256([]byte(key))
+		f, err := os.CreateTemp(c.dir, cgiCacheFilePrefix+hex.EncodeToString(sum[:8])+"-*")
+		if err != nil {
+			log.Println("Error storing CGI response in cache:", err)
+			return
+		}
+
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Println("Error storing CGI response in cache:", err)
+			os.Remove(f.Name())
+			return
+		}
+
+		entry.path = f.Name()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// A response served from the cache of a CGI backend.
+type CachedCgiResponse struct {
+	body io.Reader
+	file *os.File
+}
+
+func (resp *CachedCgiResponse) Backend() string {
+	return "cgi"
+}
+
+func (resp *CachedCgiResponse) Init(req *Request) (err error) {
+	return
+}
+
+func (resp *CachedCgiResponse) Send(w ResponseWriter) (err error) {
+	r := bufio.NewReaderSize(resp.body, 4096)
+	header, err := readHeader(r)
+	if err != nil {
+		return
+	}
+
+	w.WriteHeader(header.Status, header.Meta)
+	_, err = io.Copy(w, r)
+	return
+}
+
+func (resp *CachedCgiResponse) Close() {
+	if resp.file != nil {
+		resp.file.Close()
+	}
+}
+
+var _ Response = (*CachedCgiResponse)(nil)
@@ -0,0 +1,112 @@
+package hodhod
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Returns true if the given file should be run as a CGI script. If the backend
+// has no cgi_exts, any executable file is a script.
+func isCgiScript(backend *Backend, filename string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return false
+	}
+
+	return hasCgiExt(backend, filename)
+}
+
+func hasCgiExt(backend *Backend, filename string) bool {
+	if len(backend.CgiExts) == 0 {
+		return true
+	}
+
+	for _, ext := range backend.CgiExts {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Walks the unmatched part of the request path inside the backend location,
+// looking for a CGI script. If a script is found, the rest of the path becomes
+// its PATH_INFO. Returns nil if the path does not lead to a script, in which
+// case it should be served as a static file. If the path leads to a file that
+// looks like a script, but is not executable, forbidden is set to true; such
+// files should not be served at all, so that script sources are not leaked.
+func findCgiScript(backend *Backend, req *Request, unmatched string) (script *CgiScript, forbidden bool) {
+	reqPath := path.Clean("/" + unmatched)
+	if !backend.AllowDotfiles && hasDotSegment(reqPath) {
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(reqPath, "/"), "/")
+	filename := backend.Location
+	for i, segment := range segments {
+		if segment == "" {
+			break
+		}
+
+		// open the file instead of just resolving it, so that the checks below
+		// are done on the file openConfined has made sure is inside the
+		// location. the script is still run by its path, so it could be
+		// replaced before it starts; that is why scripts in directories other
+		// users can write to need to run as those users.
+		filename = filepath.Join(filename, segment)
+		f, err := openConfined(filename, backend)
+		if err != nil {
+			return
+		}
+
+		resolved := f.Name()
+		info, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return
+		}
+
+		if info.IsDir() {
+			continue
+		}
+
+		if !isCgiScript(backend, resolved, info) {
+			forbidden = len(backend.CgiExts) > 0 && hasCgiExt(backend, resolved)
+			return
+		}
+
+		prefix, _ := splitScriptPath(req.Url.Path, unmatched)
+		pathInfo := ""
+		if i < len(segments)-1 {
+			pathInfo = "/" + strings.Join(segments[i+1:], "/")
+			if strings.HasSuffix(req.Url.Path, "/") {
+				pathInfo += "/"
+			}
+		}
+
+		script = &CgiScript{
+			Path:         resolved,
+			Name:         prefix + "/" + strings.Join(segments[:i+1], "/"),
+			PathInfo:     pathInfo,
+			DocumentRoot: backend.Location,
+		}
+		return
+	}
+
+	return
+}
+
+func NewCgiDirResp(backend *Backend, unmatched string, req Request, cfg *Config) (resp Response) {
+	script, forbidden := findCgiScript(backend, &req, unmatched)
+	if forbidden {
+		return NewStatusResp(51, "Not Found")
+	}
+
+	if script != nil {
+		return NewCgiResp(req, backend, *script, cfg)
+	}
+
+	return NewFileResp(backend, unmatched, req, cfg)
+}
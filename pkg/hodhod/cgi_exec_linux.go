@@ -0,0 +1,137 @@
+package hodhod
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const cgiSandboxSupported = true
+
+// Linux value of RLIMIT_NPROC, which is not defined in the syscall package.
+const rlimitNproc = 6
+
+// Puts the script in a new process group, and makes sure the whole group is
+// killed when the script is cancelled, so that no children of the script are
+// left running after a timeout.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Kills whatever is left of the process group of a script after it has exited,
+// like children still running in the background.
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func cgiExecFail(whileDoing string, err error) {
+	fmt.Fprintf(os.Stderr, "hodhod: error %s: %s\n", whileDoing, err)
+	os.Exit(127)
+}
+
+// The entry point of the cgi-exec wrapper. Sets up resource limits, the root
+// directory, the working directory and the user as specified in the arguments,
+// and then replaces itself with the CGI script. Never returns.
+func RunCgiExec(args []string) {
+	flags := flag.NewFlagSet(CgiExecCommand, flag.ExitOnError)
+	uid := flags.Int("uid", -1, "")
+	gid := flags.Int("gid", -1, "")
+	groups := flags.String("groups", "", "")
+	chroot := flags.String("chroot", "", "")
+	dir := flags.String("dir", "", "")
+	cpu := flags.Uint64("cpu", 0, "")
+	memory := flags.Uint64("memory", 0, "")
+	openFiles := flags.Uint64("open-files", 0, "")
+	processes := flags.Uint64("processes", 0, "")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		cgiExecFail("parsing arguments", fmt.Errorf("expected script path"))
+	}
+	scriptPath := flags.Arg(0)
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, *cpu},
+		{syscall.RLIMIT_AS, *memory},
+		{syscall.RLIMIT_NOFILE, *openFiles},
+		{rlimitNproc, *processes},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+
+		rlimit := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		err := syscall.Setrlimit(limit.resource, &rlimit)
+		if err != nil {
+			cgiExecFail("setting resource limit", err)
+		}
+	}
+
+	if *chroot != "" {
+		err := syscall.Chroot(*chroot)
+		if err != nil {
+			cgiExecFail("changing root directory", err)
+		}
+
+		err = os.Chdir("/")
+		if err != nil {
+			cgiExecFail("changing directory", err)
+		}
+	}
+
+	if *dir != "" {
+		err := os.Chdir(*dir)
+		if err != nil {
+			cgiExecFail("changing directory", err)
+		}
+	}
+
+	// the order matters here: we can't change groups after dropping root
+	// privileges.
+	if *groups != "" || *uid >= 0 || *gid >= 0 {
+		var gids []int
+		for _, g := range strings.Split(*groups, ",") {
+			id, err := strconv.Atoi(g)
+			if err == nil {
+				gids = append(gids, id)
+			}
+		}
+
+		err := syscall.Setgroups(gids)
+		if err != nil {
+			cgiExecFail("setting supplementary groups", err)
+		}
+	}
+
+	if *gid >= 0 {
+		err := syscall.Setgid(*gid)
+		if err != nil {
+			cgiExecFail("setting group", err)
+		}
+	}
+
+	if *uid >= 0 {
+		err := syscall.Setuid(*uid)
+		if err != nil {
+			cgiExecFail("setting user", err)
+		}
+	}
+
+	err := syscall.Exec(scriptPath, []string{scriptPath}, os.Environ())
+	cgiExecFail("executing script", err)
+}
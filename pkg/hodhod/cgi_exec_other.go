@@ -0,0 +1,22 @@
+//go:build !linux
+
+package hodhod
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const cgiSandboxSupported = false
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+}
+
+func RunCgiExec(args []string) {
+	fmt.Fprintln(os.Stderr, "hodhod: CGI sandboxing is not supported on this platform")
+	os.Exit(127)
+}
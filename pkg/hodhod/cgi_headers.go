@@ -0,0 +1,124 @@
+package hodhod
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maximum number of header lines accepted from a CGI script in parsed
+	// mode. The length of each line is limited by the size of the buffered
+	// reader.
+	maxCgiHeaderLines = 100
+)
+
+var errIncompleteCgiHeaders = errors.New("CGI script output ended before the end of headers")
+
+// Reads CGI-style headers (e.g. "Status: 20", "Content-Type: text/gemini" or
+// "Location: gemini://example.org/") from the output of a script running in
+// parsed mode, up to and including the empty line that ends them, and returns
+// the equivalent Gemini header. Unknown headers are ignored.
+//
+// maxAge is the number of seconds the response can be cached for, as set by a
+// "Cache-Control" header, or -1 if the script did not say.
+func parseCgiHeaders(r *bufio.Reader, defaultType string) (header Header, maxAge int, err error) {
+	maxAge = -1
+	status := 0
+	statusText := ""
+	contentType := ""
+	location := ""
+
+	for i := 0; ; i++ {
+		if i == maxCgiHeaderLines {
+			err = fmt.Errorf("Too many header lines in CGI script output")
+			return
+		}
+
+		var line []byte
+		line, err = r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = fmt.Errorf("Header line too long in CGI script output")
+			return
+		} else if err != nil {
+			err = errIncompleteCgiHeaders
+			return
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+
+		name, value, ok := strings.Cut(string(line), ":")
+		if !ok {
+			err = fmt.Errorf("Invalid header line in CGI script output: %s", line)
+			return
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "status":
+			codeStr, text, _ := strings.Cut(value, " ")
+			status, err = strconv.Atoi(codeStr)
+			if err != nil || len(codeStr) != 2 || status < 10 || status > 69 {
+				err = fmt.Errorf("Invalid status in CGI script output: %s", value)
+				return
+			}
+			statusText = strings.TrimSpace(text)
+		case "content-type":
+			contentType = value
+		case "location":
+			location = value
+		case "cache-control":
+			maxAge = parseCacheControl(value, maxAge)
+		}
+	}
+
+	meta := statusText
+	switch {
+	case status == 0 && location != "":
+		status = 30
+		meta = location
+	case status == 0 || status/10 == 2:
+		if status == 0 {
+			status = 20
+		}
+		meta = contentType
+		if meta == "" {
+			meta = defaultType
+		}
+	case status/10 == 3 && location != "":
+		meta = location
+	}
+
+	header = Header{
+		Status: status,
+		Meta:   meta,
+	}
+	err = header.Validate()
+	return
+}
+
+// Returns the number of seconds a response can be cached for according to the
+// given value of a Cache-Control header, or current if the header does not
+// say.
+func parseCacheControl(value string, current int) int {
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+			if err == nil && seconds >= 0 {
+				current = seconds
+			}
+		}
+	}
+
+	return current
+}
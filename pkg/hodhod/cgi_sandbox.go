@@ -0,0 +1,100 @@
+package hodhod
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The hidden command line argument that makes hodhod act as a wrapper that
+// sets up the sandbox of a CGI script (resource limits, chroot and user) and
+// then executes the script. See RunCgiExec.
+const CgiExecCommand = "__cgi_exec__"
+
+// Returns true if any of the options requiring the cgi-exec wrapper are set for
+// the backend.
+func (backend *Backend) needsSandbox() bool {
+	return backend.User != "" ||
+		backend.Group != "" ||
+		backend.Chroot != "" ||
+		backend.Rlimits != (RlimitsConfig{})
+}
+
+// Returns the path and the arguments for running the given script through the
+// cgi-exec wrapper.
+func cgiExecCommand(backend *Backend, script *CgiScript) (path string, args []string, err error) {
+	path, err = os.Executable()
+	if err != nil {
+		return
+	}
+
+	args = []string{path, CgiExecCommand}
+
+	if backend.User != "" {
+		var u *user.User
+		u, err = user.Lookup(backend.User)
+		if err != nil {
+			return
+		}
+
+		var groups []string
+		groups, err = u.GroupIds()
+		if err != nil {
+			return
+		}
+
+		args = append(args, "-uid", u.Uid, "-gid", u.Gid, "-groups", strings.Join(groups, ","))
+	}
+
+	if backend.Group != "" {
+		var g *user.Group
+		g, err = user.LookupGroup(backend.Group)
+		if err != nil {
+			return
+		}
+
+		args = append(args, "-gid", g.Gid)
+	}
+
+	scriptPath := script.Path
+	if backend.Chroot != "" {
+		// the script is executed after changing the root, so its path should
+		// be relative to the new root.
+		var rel string
+		rel, err = filepath.Rel(backend.Chroot, script.Path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			err = fmt.Errorf("Script %s is not inside chroot directory %s", script.Path, backend.Chroot)
+			return
+		}
+
+		scriptPath = "/" + rel
+		args = append(args, "-chroot", backend.Chroot)
+	}
+
+	// without a chroot, the working directory is set when starting the
+	// wrapper, and there's no need to pass it on.
+	if backend.Chroot != "" && backend.WorkingDir != "" {
+		args = append(args, "-dir", backend.WorkingDir)
+	}
+
+	limits := []struct {
+		name  string
+		value uint64
+	}{
+		{"cpu", backend.Rlimits.Cpu},
+		{"memory", backend.Rlimits.Memory},
+		{"open-files", backend.Rlimits.OpenFiles},
+		{"processes", backend.Rlimits.Processes},
+	}
+	for _, limit := range limits {
+		if limit.value != 0 {
+			args = append(args, "-"+limit.name, strconv.FormatUint(limit.value, 10))
+		}
+	}
+
+	args = append(args, "--", scriptPath)
+	return
+}
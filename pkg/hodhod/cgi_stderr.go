@@ -0,0 +1,89 @@
+package hodhod
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Loggers for the stderr_file option of CGI backends, keyed by file path, so
+// that each file is only opened once.
+var stderrLoggers = struct {
+	sync.Mutex
+	loggers map[string]*log.Logger
+}{
+	loggers: map[string]*log.Logger{},
+}
+
+// Returns the logger CGI stderr output for the given backend should be written
+// to.
+func getStderrLogger(backend *Backend) *log.Logger {
+	if backend.StderrFile == "" {
+		return log.Default()
+	}
+
+	stderrLoggers.Lock()
+	defer stderrLoggers.Unlock()
+
+	logger, ok := stderrLoggers.loggers[backend.StderrFile]
+	if ok {
+		return logger
+	}
+
+	f, err := os.OpenFile(backend.StderrFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Println("Error opening CGI stderr file; using the main log instead:", err)
+		return log.Default()
+	}
+
+	logger = log.New(f, "", log.LstdFlags)
+	stderrLoggers.loggers[backend.StderrFile] = logger
+	return logger
+}
+
+// Reads the stderr of a CGI script until it is closed, and logs it according to
+// the stderr option of the backend. The stderr pipe is expected to be closed
+// with an error if the script fails.
+func handleCgiStderr(r io.Reader, backend *Backend, scriptPath string, req *Request) {
+	if backend.Stderr == "" || backend.Stderr == "discard" {
+		io.Copy(io.Discard, r)
+		return
+	}
+
+	logger := getStderrLogger(backend)
+	logLine := func(line string) {
+		logger.Printf("CGI stderr: script=%s id=%s: %s\n", scriptPath, req.Id, line)
+	}
+
+	// the scanner buffer is large enough that a line can only be too long if it
+	// is over the limit anyway.
+	limited := &io.LimitedReader{R: r, N: backend.StderrLimit}
+	s := bufio.NewScanner(limited)
+	s.Buffer(make([]byte, 0, 4096), int(backend.StderrLimit)+1)
+
+	var lines []string
+	for s.Scan() {
+		if backend.Stderr == "log" {
+			logLine(s.Text())
+		} else {
+			lines = append(lines, s.Text())
+		}
+	}
+
+	// whatever is left after the limit is discarded, but we still need to read
+	// it, so that the script does not block writing to stderr.
+	discarded, err := io.Copy(io.Discard, r)
+	failed := err != nil || (s.Err() != nil && s.Err() != bufio.ErrTooLong)
+
+	if backend.Stderr == "onerror" && failed {
+		for _, line := range lines {
+			logLine(line)
+		}
+	}
+
+	if discarded > 0 && (backend.Stderr == "log" || failed) {
+		logLine("(stderr truncated)")
+	}
+}
@@ -0,0 +1,55 @@
+package hodhod
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCgiLeftoverChild(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Scripts are only run in their own process group on Linux.")
+	}
+
+	script := filepath.Join(t.TempDir(), "script.cgi")
+	err := os.WriteFile(script, []byte("#!/bin/sh\nprintf '20 text/gemini\\r\\nhi\\n'\nsleep 30 &\nexit 0\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{CgiTimeout: 2}
+	backend := &Backend{Name: "cgi", Type: "cgi", Script: script}
+	setCgiDefaults(backend)
+
+	u, _ := url.Parse("gemini://localhost/")
+	req := Request{Url: u}
+	resp := NewCgiResp(req, backend, NewCgiScript(backend, &req, ""), cfg)
+	defer resp.Close()
+
+	var out bytes.Buffer
+	errc := make(chan error, 1)
+	go func() {
+		resp.Init(&req)
+		errc <- resp.(*CgiResponse).Send(&connResponseWriter{out: &out, req: &req})
+	}()
+
+	// the child left running in the background holds on to the output of
+	// the script, so the response would only finish when it exits, if it
+	// was not killed.
+	select {
+	case err = <-errc:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Response not finished while a child of the script is running.")
+	}
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if out.String() != "20 text/gemini\r\nhi\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
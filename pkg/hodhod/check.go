@@ -0,0 +1,166 @@
+package hodhod
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// certificates expiring within this time are reported by CheckConfig
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// Checks a loaded config for problems that LoadConfig does not catch, such as
+// missing files, certificates that cannot be loaded, or routes that can never
+// be matched. Errors are problems that would prevent the server from working
+// properly, while warnings are most likely mistakes in the config.
+func CheckConfig(cfg *Config) (errs []error, warnings []string) {
+	certs, err := loadCertificates(cfg)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Could not load certificates: %s", err))
+		certs = nil
+	}
+
+	for _, backend := range cfg.Backends {
+		err = checkBackendFiles(&backend)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i, route := range cfg.Routes {
+		for j := 0; j < i; j++ {
+			if routeShadows(cfg.Routes[j], route, cfg) {
+				warnings = append(warnings, fmt.Sprintf("Route %d (%s) will never be matched because route %d (%s) comes before it.", i+1, route.Pattern(), j+1, cfg.Routes[j].Pattern()))
+				break
+			}
+		}
+
+		hostname := routeHostname(route)
+		if hostname == "" || certs == nil {
+			continue
+		}
+
+		found := false
+		for _, cert := range certs {
+			if cert.Leaf.VerifyHostname(hostname) == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("No certificate matches hostname '%s' of route %d.", hostname, i+1))
+		}
+	}
+
+	for i, cert := range certs {
+		left := time.Until(cert.Leaf.NotAfter)
+		if left <= 0 {
+			warnings = append(warnings, fmt.Sprintf("Certificate %s has expired on %s.", cfg.Certs[i].CertFile, cert.Leaf.NotAfter.Format(time.RFC3339)))
+		} else if left < certExpiryWarning {
+			warnings = append(warnings, fmt.Sprintf("Certificate %s expires in %d days, on %s.", cfg.Certs[i].CertFile, int(left.Hours()/24), cert.Leaf.NotAfter.Format(time.RFC3339)))
+		}
+	}
+
+	return
+}
+
+// Makes sure the files a backend serves from exist.
+func checkBackendFiles(backend *Backend) error {
+	switch backend.Type {
+	case "static", "cgi_dir":
+		info, err := os.Stat(backend.Location)
+		if err != nil {
+			return fmt.Errorf("Location of backend '%s' is not accessible: %s", backend.Name, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Location of backend '%s' is not a directory: %s", backend.Name, backend.Location)
+		}
+	case "cgi":
+		info, err := os.Stat(backend.Script)
+		if err != nil {
+			return fmt.Errorf("Script of backend '%s' is not accessible: %s", backend.Name, err)
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			return fmt.Errorf("Script of backend '%s' is not an executable file: %s", backend.Name, backend.Script)
+		}
+	}
+
+	return nil
+}
+
+// Returns true if every URL matched by the second route is also matched by the
+// first one, so the second one can never be reached if it comes after the
+// first.
+func routeShadows(first Route, second Route, cfg *Config) bool {
+	switch {
+	case first.Hostname != "":
+		return routeHostname(second) == first.Hostname && !partialHost(second)
+	case first.Prefix != "":
+		switch {
+		case second.Hostname != "":
+			return strings.HasPrefix(hostnameUrlPrefix(second.Hostname, cfg), first.Prefix)
+		case second.Prefix != "":
+			return strings.HasPrefix(second.Prefix, first.Prefix)
+		case second.Url != "":
+			return strings.HasPrefix(second.Url, first.Prefix)
+		}
+	case first.Url != "":
+		return second.Url == first.Url
+	}
+
+	return false
+}
+
+// Returns the longest prefix all the normalized URLs with the given hostname
+// have, when requests are received on the configured listen address.
+func hostnameUrlPrefix(hostname string, cfg *Config) string {
+	prefix := "gemini://" + hostname
+
+	// the default port is removed when normalizing
+	_, port, err := net.SplitHostPort(cfg.ListenAddr)
+	if err == nil && port != "1965" {
+		prefix += ":" + port
+	}
+
+	// unless a trailing slash is added, the path might be empty
+	if cfg.MatchOptions.TrailingSlash == "ensure" {
+		prefix += "/"
+	}
+
+	return prefix
+}
+
+// Returns the hostname the URLs matched by the route have, or an empty string
+// if it cannot be determined.
+func routeHostname(route Route) string {
+	if route.Hostname != "" {
+		return route.Hostname
+	}
+
+	pattern := route.Prefix
+	if pattern == "" {
+		pattern = route.Url
+	}
+
+	u, err := url.Parse(pattern)
+	if err != nil {
+		return ""
+	}
+
+	return u.Hostname()
+}
+
+// Returns true if the route is a prefix route whose prefix could end in the
+// middle of the hostname, like gemini://example, which also matches URLs with
+// other hostnames, like gemini://example.org.
+func partialHost(route Route) bool {
+	if route.Prefix == "" {
+		return false
+	}
+
+	rest := strings.TrimPrefix(route.Prefix, "gemini://")
+	return !strings.ContainsAny(rest, "/:?")
+}
@@ -1,6 +1,8 @@
 package hodhod
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -15,12 +17,108 @@ type Route struct {
 	Backend  string `json:"backend"`
 }
 
+// Returns the pattern of the route, along with its kind, e.g.
+// "prefix gemini://example.org/".
+func (route Route) Pattern() string {
+	switch {
+	case route.Hostname != "":
+		return "hostname " + route.Hostname
+	case route.Prefix != "":
+		return "prefix " + route.Prefix
+	default:
+		return "url " + route.Url
+	}
+}
+
 type Backend struct {
-	Name     string `json:"name"`
-	Type     string `json:"type"`
-	Location string `json:"location"`
-	FileExt  string `json:"file_ext"`
-	Script   string `json:"script"`
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`
+	Location        string            `json:"location"`
+	FileExt         string            `json:"file_ext"`
+	FollowSymlinks  string            `json:"follow_symlinks"`
+	AllowDotfiles   bool              `json:"allow_dotfiles"`
+	Script          string            `json:"script"`
+	AllowedUsers    []string          `json:"allowed_users"`
+	Cgi             bool              `json:"cgi"`
+	Lang            string            `json:"lang"`
+	Charset         string            `json:"charset"`
+	DirParams       []DirParams       `json:"dir_params"`
+	MetaFile        string            `json:"meta_file"`
+	Status          int               `json:"status"`
+	Meta            string            `json:"meta"`
+	NotFoundPage    string            `json:"not_found_page"`
+	ErrorPage       string            `json:"error_page"`
+	Stderr          string            `json:"stderr"`
+	StderrFile      string            `json:"stderr_file"`
+	StderrLimit     int64             `json:"stderr_limit"`
+	Env             map[string]string `json:"env"`
+	InheritEnv      []string          `json:"inherit_env"`
+	CgiExts         []string          `json:"cgi_exts"`
+	User            string            `json:"user"`
+	Group           string            `json:"group"`
+	WorkingDir      string            `json:"working_dir"`
+	Chroot          string            `json:"chroot"`
+	Rlimits         RlimitsConfig     `json:"rlimits"`
+	MaxResponseSize int64             `json:"max_response_size"`
+	Streaming       bool              `json:"streaming"`
+	CgiMode         string            `json:"cgi_mode"`
+	Cache           CgiCacheConfig    `json:"cache"`
+	Handler         string            `json:"handler"`
+
+	// Options of backend types not present in the above fields, as returned by
+	// the Decode function of the backend type
+	Options interface{} `json:"-"`
+
+	// the backend as it appeared in the config file, if it was loaded from one
+	raw json.RawMessage
+}
+
+func (backend *Backend) UnmarshalJSON(data []byte) (err error) {
+	// the alias type does not have this method, so this does not recurse
+	type plainBackend Backend
+	err = json.Unmarshal(data, (*plainBackend)(backend))
+	if err != nil {
+		return
+	}
+
+	backend.raw = append(json.RawMessage(nil), data...)
+	return
+}
+
+// Resource limits for CGI scripts. Zero means no limit.
+type RlimitsConfig struct {
+	// CPU time, in seconds
+	Cpu uint64 `json:"cpu"`
+
+	// Address space size, in bytes
+	Memory uint64 `json:"memory"`
+
+	OpenFiles uint64 `json:"open_files"`
+	Processes uint64 `json:"processes"`
+}
+
+// Caching of the responses of a CGI backend.
+type CgiCacheConfig struct {
+	// Number of seconds responses are cached for, unless the script says
+	// otherwise; zero means only the responses the script opts in are cached
+	Ttl int `json:"ttl"`
+
+	// Total size of the cached responses, in bytes; zero disables caching
+	MaxSize int64 `json:"max_size"`
+
+	// If set, responses are stored in this directory instead of memory
+	Dir string `json:"dir"`
+
+	// If true, responses are cached separately for each client certificate
+	PerCert bool `json:"per_cert"`
+}
+
+// Parameters added to the content type of text files inside a directory of a
+// static backend.
+type DirParams struct {
+	Dir     string `json:"dir"`
+	Lang    string `json:"lang"`
+	Charset string `json:"charset"`
 }
 
 type Cert struct {
@@ -38,63 +136,153 @@ type MatchOptionsConfig struct {
 type ContentTypeConfig struct {
 	Default string            `json:"default"`
 	ExtMap  map[string]string `json:"ext_map"`
+	Sniff   bool              `json:"sniff"`
 }
 
-type Config struct {
-	ListenAddr   string             `json:"listen"`
-	MatchOptions MatchOptionsConfig `json:"match_options"`
-	CgiTimeout   int                `json:"cgi_timeout"`
-	Routes       []Route            `json:"routes"`
-	Backends     []Backend          `json:"backends"`
-	Certs        []Cert             `json:"certs"`
-	ContentType  ContentTypeConfig  `json:"content_type"`
+// Connection timeouts, in seconds.
+type TimeoutsConfig struct {
+	// Time allowed for the TLS handshake
+	Handshake int `json:"handshake"`
+
+	// Time allowed for receiving the request, after the handshake
+	RequestRead int `json:"request_read"`
+
+	// Time allowed for each write to the client to complete
+	IdleWrite int `json:"idle_write"`
+
+	// Maximum duration of the whole connection; zero means no limit
+	Total int `json:"total"`
 }
 
-func LoadConfig(configFilePath string) (config Config, err error) {
-	f, err := os.Open(configFilePath)
-	if err != nil {
-		return
-	}
-	defer f.Close()
+// In-memory cache for files served by static backends.
+type StaticCacheConfig struct {
+	// Total size of the cached file contents, in bytes; zero disables the
+	// cache
+	MaxSize int64 `json:"max_size"`
+
+	// Files larger than this are never cached
+	MaxFileSize int64 `json:"max_file_size"`
 
-	// set top-level default values
+	// Number of seconds a failed file lookup is remembered for
+	NegativeTtl int `json:"negative_ttl"`
+}
+
+type MaintenanceConfig struct {
+	Hostname    string   `json:"hostname"`
+	FlagFile    string   `json:"flag_file"`
+	Message     string   `json:"message"`
+	BypassCerts []string `json:"bypass_certs"`
+}
+
+type Config struct {
+	ListenAddr    string              `json:"listen"`
+	MatchOptions  MatchOptionsConfig  `json:"match_options"`
+	CgiTimeout    int                 `json:"cgi_timeout"`
+	Timeouts      TimeoutsConfig      `json:"timeouts"`
+	Routes        []Route             `json:"routes"`
+	Backends      []Backend           `json:"backends"`
+	Certs         []Cert              `json:"certs"`
+	ContentType   ContentTypeConfig   `json:"content_type"`
+	Maintenance   []MaintenanceConfig `json:"maintenance"`
+	AdminSocket   string              `json:"admin_socket"`
+	NotFoundPages map[string]string   `json:"not_found_pages"`
+	StaticCache   StaticCacheConfig   `json:"static_cache"`
+}
+
+// Returns a config with all top-level options set to their default values, for
+// building a config programmatically instead of loading it from a file. Once
+// done, Prepare should be called before using it.
+func NewConfig() (config Config) {
 	config.ListenAddr = "127.0.0.1:1965"
 	config.MatchOptions.QueryParams = "remove"
 	config.MatchOptions.TrailingSlash = "ensure"
 	config.MatchOptions.DefaultExts = []string{"gmi"}
 	config.MatchOptions.IndexFilename = "index.gmi"
 	config.CgiTimeout = 10
+	config.Timeouts.Handshake = 10
+	config.Timeouts.RequestRead = 10
+	config.Timeouts.IdleWrite = 30
+	config.StaticCache.MaxFileSize = 128 * 1024
+	config.StaticCache.NegativeTtl = 5
 	config.ContentType.Default = "text/gemini"
+	config.ContentType.Sniff = true
 	config.ContentType.ExtMap = map[string]string{
-		"aac":  "audio/aac",
-		"csv":  "text/csv",
-		"gif":  "image/gif",
-		"htm":  "text/html",
-		"html": "text/html",
-		"jpeg": "image/jpeg",
-		"jpg":  "image/jpeg",
-		"md":   "text/markdown",
-		"mkv":  "video/x-matroska",
-		"mp3":  "audio/mpeg",
-		"mp4":  "video/mp4",
-		"oga":  "audio/ogg",
-		"ogv":  "video/ogg",
-		"png":  "image/png",
-		"txt":  "text/plain",
-		"wav":  "audio/wav",
+		"aac":    "audio/aac",
+		"csv":    "text/csv",
+		"gemini": "text/gemini",
+		"gif":    "image/gif",
+		"gmi":    "text/gemini",
+		"htm":    "text/html",
+		"html":   "text/html",
+		"jpeg":   "image/jpeg",
+		"jpg":    "image/jpeg",
+		"md":     "text/markdown",
+		"mkv":    "video/x-matroska",
+		"mp3":    "audio/mpeg",
+		"mp4":    "video/mp4",
+		"oga":    "audio/ogg",
+		"ogv":    "video/ogg",
+		"png":    "image/png",
+		"txt":    "text/plain",
+		"wav":    "audio/wav",
+	}
+
+	return
+}
+
+func LoadConfig(configFilePath string) (config Config, err error) {
+	f, err := os.Open(configFilePath)
+	if err != nil {
+		return
 	}
+	defer f.Close()
 
+	config = NewConfig()
 	decoder := json.NewDecoder(f)
 	err = decoder.Decode(&config)
 
 	if err == nil {
-		setDefaultsAndNormalize(&config)
-		err = validateConfig(&config)
+		err = config.Prepare()
 	}
 
 	return
 }
 
+// Sets the default values of the routes and backends, and validates the config.
+// LoadConfig already does this for configs loaded from a file.
+func (cfg *Config) Prepare() (err error) {
+	err = decodeBackends(cfg)
+	if err != nil {
+		return
+	}
+
+	setDefaultsAndNormalize(cfg)
+	return validateConfig(cfg)
+}
+
+// Adds a route to the config. Returns the config, so that calls can be chained.
+func (cfg *Config) AddRoute(route Route) *Config {
+	cfg.Routes = append(cfg.Routes, route)
+	return cfg
+}
+
+// Adds a backend to the config. Returns the config, so that calls can be
+// chained.
+func (cfg *Config) AddBackend(backend Backend) *Config {
+	cfg.Backends = append(cfg.Backends, backend)
+	return cfg
+}
+
+// Adds a certificate to the config, given the paths to its certificate and key
+// files. Returns the config, so that calls can be chained.
+func (cfg *Config) AddCert(certFile string, keyFile string) *Config {
+	cfg.Certs = append(cfg.Certs, Cert{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	return cfg
+}
+
 func (cfg *Config) GetBackendByName(name string) *Backend {
 	for _, backend := range cfg.Backends {
 		if backend.Name == name {
@@ -105,7 +293,9 @@ func (cfg *Config) GetBackendByName(name string) *Backend {
 	return nil
 }
 
-func (cfg *Config) GetBackendByUrl(u url.URL) (backend *Backend, unmatched string) {
+// Returns the URL as it is matched against routes, after applying the match
+// options and removing the default port.
+func (cfg *Config) NormalizeUrl(u url.URL) url.URL {
 	if cfg.MatchOptions.QueryParams != "include" {
 		u.RawQuery = ""
 	}
@@ -125,29 +315,42 @@ func (cfg *Config) GetBackendByUrl(u url.URL) (backend *Backend, unmatched strin
 		u.Host = u.Hostname()
 	}
 
+	return u
+}
+
+// Returns the first route matching the given URL, along with its backend and the
+// part of the URL path not matched by the route. All return values are empty
+// if no route matches.
+func (cfg *Config) MatchRoute(u url.URL) (route *Route, backend *Backend, unmatched string) {
+	u = cfg.NormalizeUrl(u)
 	ustr := u.String()
 
-	for _, route := range cfg.Routes {
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
 		switch {
-		case route.Hostname != "" && route.Hostname == u.Hostname():
+		case r.Hostname != "" && r.Hostname == u.Hostname():
 			unmatched = u.Path
 			if len(unmatched) > 0 {
 				// remove leading slash, so we can join the path to "location"
 				unmatched = unmatched[1:]
 			}
-			backend = cfg.GetBackendByName(route.Backend)
+			route = r
+			backend = cfg.GetBackendByName(r.Backend)
 			return
-		case route.Prefix != "" && strings.HasPrefix(ustr, route.Prefix):
-			if len(u.Path) > len(route.Prefix) {
-				unmatched = u.Path[len(route.Prefix):]
-				if unmatched[0] == '/' {
-					unmatched = unmatched[1:]
-				}
+		case r.Prefix != "" && strings.HasPrefix(ustr, r.Prefix):
+			// the prefix is matched against the full url, but the unmatched
+			// part should only contain what comes after the path part of the
+			// prefix.
+			prefixUrl, perr := url.Parse(r.Prefix)
+			if perr == nil && strings.HasPrefix(u.Path, prefixUrl.Path) {
+				unmatched = strings.TrimPrefix(u.Path[len(prefixUrl.Path):], "/")
 			}
-			backend = cfg.GetBackendByName(route.Backend)
+			route = r
+			backend = cfg.GetBackendByName(r.Backend)
 			return
-		case route.Url != "" && route.Url == u.String():
-			backend = cfg.GetBackendByName(route.Backend)
+		case r.Url != "" && r.Url == u.String():
+			route = r
+			backend = cfg.GetBackendByName(r.Backend)
 			return
 		}
 	}
@@ -155,6 +358,11 @@ func (cfg *Config) GetBackendByUrl(u url.URL) (backend *Backend, unmatched strin
 	return
 }
 
+func (cfg *Config) GetBackendByUrl(u url.URL) (backend *Backend, unmatched string) {
+	_, backend, unmatched = cfg.MatchRoute(u)
+	return
+}
+
 func setDefaultsAndNormalize(cfg *Config) {
 	for i, route := range cfg.Routes {
 		if route.Prefix != "" && !strings.HasPrefix(route.Prefix, "gemini://") {
@@ -166,9 +374,16 @@ func setDefaultsAndNormalize(cfg *Config) {
 		}
 	}
 
+	for i, m := range cfg.Maintenance {
+		if m.Message == "" {
+			cfg.Maintenance[i].Message = DefaultMaintenanceMessage
+		}
+	}
+
 	for i, backend := range cfg.Backends {
-		if backend.Type == "static" && backend.FileExt == "" {
-			cfg.Backends[i].FileExt = "strip"
+		backendType, ok := lookupBackendType(backend.Type)
+		if ok && backendType.SetDefaults != nil {
+			backendType.SetDefaults(&cfg.Backends[i])
 		}
 	}
 }
@@ -222,20 +437,45 @@ func validateConfig(cfg *Config) (err error) {
 			return fmt.Errorf("Backend has no name.")
 		}
 
-		switch backend.Type {
-		case "static":
-			if backend.Location == "" {
-				return fmt.Errorf("Location missing for static backend.")
-			}
-			if backend.FileExt != "strip" && backend.FileExt != "include" {
-				return fmt.Errorf("Invalid value '%s' for file_ext option; valid values are 'strip' and 'include'.", backend.FileExt)
+		if backend.MaxResponseSize < 0 {
+			return fmt.Errorf("Invalid value %d for max_response_size option.", backend.MaxResponseSize)
+		}
+
+		// the type is known to exist, since it has been checked when decoding
+		// the backends.
+		backendType, _ := lookupBackendType(backend.Type)
+		if backendType.Validate != nil {
+			err = backendType.Validate(&backend, cfg)
+			if err != nil {
+				return
 			}
-		case "cgi":
-			if backend.Script == "" {
-				return fmt.Errorf("Script missing for cgi backend.")
+		}
+	}
+
+	if cfg.Timeouts.Handshake <= 0 || cfg.Timeouts.RequestRead <= 0 || cfg.Timeouts.IdleWrite <= 0 || cfg.Timeouts.Total < 0 {
+		return fmt.Errorf("Invalid timeouts; handshake, request_read and idle_write should be positive, and total should not be negative.")
+	}
+
+	if cfg.StaticCache.MaxSize < 0 || cfg.StaticCache.MaxFileSize < 0 || cfg.StaticCache.NegativeTtl < 0 {
+		return fmt.Errorf("Invalid static_cache options; max_size, max_file_size and negative_ttl should not be negative.")
+	}
+
+	hostnames := map[string]bool{}
+	for _, m := range cfg.Maintenance {
+		if hostnames[m.Hostname] {
+			return fmt.Errorf("Multiple maintenance entries for hostname '%s'.", m.Hostname)
+		}
+		hostnames[m.Hostname] = true
+
+		if m.FlagFile == "" && cfg.AdminSocket == "" {
+			return fmt.Errorf("Maintenance entry for hostname '%s' can never be enabled; it has no flag_file and there is no admin_socket.", m.Hostname)
+		}
+
+		for _, fingerprint := range m.BypassCerts {
+			_, err := hex.DecodeString(normalizeFingerprint(fingerprint))
+			if err != nil || len(normalizeFingerprint(fingerprint)) != 2*sha256.Size {
+				return fmt.Errorf("Invalid certificate fingerprint '%s'; it should be a hex-encoded SHA-256 hash.", fingerprint)
 			}
-		default:
-			return fmt.Errorf("Invalid backend type '%s'; valid values are 'static' and 'cgi'.", backend.Type)
 		}
 	}
 
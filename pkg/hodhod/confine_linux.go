@@ -0,0 +1,11 @@
+package hodhod
+
+import (
+	"os"
+	"strconv"
+)
+
+// Returns the path of the file that is actually open, as the kernel sees it.
+func openedPath(f *os.File) (p string, err error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(int(f.Fd())))
+}
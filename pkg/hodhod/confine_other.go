@@ -0,0 +1,14 @@
+//go:build !linux
+
+package hodhod
+
+import (
+	"errors"
+	"os"
+)
+
+// The path of an open file cannot be found on this platform.
+func openedPath(f *os.File) (p string, err error) {
+	err = errors.New("Not supported on this platform.")
+	return
+}
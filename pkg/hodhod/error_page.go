@@ -0,0 +1,69 @@
+package hodhod
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns a response serving the given page with a 20 status, to be sent
+// instead of an error status. Returns nil if the page cannot be opened.
+func NewPageResp(filename string, cfg *Config) (resp Response) {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Println("Error opening error page:", err)
+		return nil
+	}
+
+	contentType, ok := cfg.ContentType.ExtMap[strings.TrimPrefix(filepath.Ext(filename), ".")]
+	if !ok {
+		contentType = cfg.ContentType.Default
+	}
+
+	return &StaticResponse{
+		file:        f,
+		body:        f,
+		contentType: contentType,
+	}
+}
+
+// Returns a response serving the not found page configured for the backend, or
+// for the hostname if the backend has none. The backend can be nil if no route
+// matched the request. Returns nil if there is no not found page.
+func NewNotFoundPageResp(backend *Backend, req *Request, cfg *Config) (resp Response) {
+	page := cfg.NotFoundPages[req.Url.Hostname()]
+	if backend != nil && backend.NotFoundPage != "" {
+		page = backend.NotFoundPage
+	}
+
+	if page == "" {
+		return nil
+	}
+
+	return NewPageResp(page, cfg)
+}
+
+// Replaces 51 and 42 responses with the not found or error page configured for
+// the backend or the hostname, if there is one. Other responses are returned
+// unchanged.
+func ApplyErrorPages(resp Response, backend *Backend, req *Request, cfg *Config) Response {
+	errResp, ok := resp.(*ErrorResponse)
+	if !ok {
+		return resp
+	}
+
+	var pageResp Response
+	switch {
+	case errResp.StatusCode == 51:
+		pageResp = NewNotFoundPageResp(backend, req, cfg)
+	case errResp.StatusCode == 42 && backend != nil && backend.ErrorPage != "":
+		pageResp = NewPageResp(backend.ErrorPage, cfg)
+	}
+
+	if pageResp == nil {
+		return resp
+	}
+
+	return pageResp
+}
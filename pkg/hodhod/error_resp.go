@@ -1,14 +1,8 @@
 package hodhod
 
-import (
-	"fmt"
-	"io"
-)
-
 type ErrorResponse struct {
-	StatusCode         int
-	Meta               string
-	returnedStatusLine bool
+	StatusCode int
+	Meta       string
 }
 
 func (resp *ErrorResponse) Backend() string {
@@ -19,19 +13,8 @@ func (resp *ErrorResponse) Init(req *Request) (err error) {
 	return
 }
 
-func (resp *ErrorResponse) Read(p []byte) (n int, err error) {
-	if resp.returnedStatusLine {
-		return 0, io.EOF
-	}
-
-	status := []byte(fmt.Sprintf("%d %s\r\n", resp.StatusCode, resp.Meta))
-	if len(p) < len(status) {
-		return 0, fmt.Errorf("Not enough space in read buffer")
-	}
-	copy(p, status)
-
-	n = len(status)
-	resp.returnedStatusLine = true
+func (resp *ErrorResponse) Send(w ResponseWriter) (err error) {
+	w.WriteHeader(resp.StatusCode, resp.Meta)
 	return
 }
 
@@ -39,4 +22,13 @@ func (resp *ErrorResponse) Close() {
 
 }
 
+// Returns a response consisting of only a status line with the given status
+// code and meta.
+func NewStatusResp(statusCode int, meta string) (resp Response) {
+	return &ErrorResponse{
+		StatusCode: statusCode,
+		Meta:       meta,
+	}
+}
+
 var _ Response = (*ErrorResponse)(nil)
@@ -0,0 +1,159 @@
+package hodhod
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Implemented by Go code serving requests routed to a handler backend.
+type Handler interface {
+	ServeGemini(w ResponseWriter, req *Request)
+}
+
+// Allows using an ordinary function as a Handler.
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+func (f HandlerFunc) ServeGemini(w ResponseWriter, req *Request) {
+	f(w, req)
+}
+
+// Wraps a handler to add some behavior to it, e.g. logging or authentication.
+type Middleware func(next Handler) Handler
+
+// Wraps the handler in the given middleware. The first middleware is the
+// outermost one, so it sees each request first.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+// Handlers registered by programs embedding hodhod, keyed by their name.
+var handlers = struct {
+	sync.Mutex
+	byName map[string]Handler
+}{
+	byName: map[string]Handler{},
+}
+
+// Registers a handler, so that handler backends can refer to it by name. The
+// handler is wrapped in the given middleware, if any. Handlers should be
+// registered before the config using them is loaded. Registering a handler
+// with the same name again replaces it.
+func RegisterHandler(name string, handler Handler, middleware ...Middleware) {
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	handlers.byName[name] = Chain(handler, middleware...)
+}
+
+func lookupHandler(name string) Handler {
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	return handlers.byName[name]
+}
+
+// Wraps the ResponseWriter passed to a handler, so that a default header is sent
+// if the handler does not send one.
+type handlerResponseWriter struct {
+	w           ResponseWriter
+	defaultType string
+	wroteHeader bool
+
+	// the first error returned from writing the response
+	err error
+}
+
+func (w *handlerResponseWriter) WriteHeader(statusCode int, meta string) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	w.w.WriteHeader(statusCode, meta)
+}
+
+func (w *handlerResponseWriter) Write(p []byte) (n int, err error) {
+	if !w.wroteHeader {
+		w.WriteHeader(20, w.defaultType)
+	}
+
+	n, err = w.w.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return
+}
+
+// A response produced by a Go handler.
+type HandlerResponse struct {
+	handler     Handler
+	streaming   bool
+	defaultType string
+	req         *Request
+}
+
+func (resp *HandlerResponse) Backend() string {
+	return "handler"
+}
+
+func (resp *HandlerResponse) Init(req *Request) (err error) {
+	resp.req = req
+	return
+}
+
+func (resp *HandlerResponse) Send(w ResponseWriter) (err error) {
+	hw := &handlerResponseWriter{
+		w:           w,
+		defaultType: resp.defaultType,
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handler panicked (id=%s): %v\n", resp.req.Id, r)
+			if !hw.wroteHeader {
+				w.WriteHeader(40, "Internal error")
+				return
+			}
+
+			// aborts the connection, since part of the response has already
+			// been sent.
+			err = fmt.Errorf("Handler panicked: %v", r)
+		}
+	}()
+
+	resp.handler.ServeGemini(hw, resp.req)
+	if !hw.wroteHeader {
+		hw.WriteHeader(20, resp.defaultType)
+	}
+
+	return hw.err
+}
+
+func (resp *HandlerResponse) Streaming() bool {
+	return resp.streaming
+}
+
+func (resp *HandlerResponse) Close() {
+}
+
+func NewHandlerResp(backend *Backend, cfg *Config) (resp Response) {
+	handler := lookupHandler(backend.Handler)
+	if handler == nil {
+		log.Printf("No handler registered with name '%s'.\n", backend.Handler)
+		return NewStatusResp(40, "Internal error")
+	}
+
+	return &HandlerResponse{
+		handler:     handler,
+		streaming:   backend.Streaming,
+		defaultType: cfg.ContentType.Default,
+	}
+}
+
+var _ Response = (*HandlerResponse)(nil)
+var _ StreamingResponse = (*HandlerResponse)(nil)
@@ -0,0 +1,79 @@
+package hodhod
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maximum length of the meta part of a status line, as specified by the
+	// Gemini spec
+	maxMetaLength = 1024
+
+	// maximum length of a whole status line: a two-digit status, a space, the
+	// meta, and CRLF
+	maxHeaderLength = 2 + 1 + maxMetaLength + 2
+)
+
+// The status line of a Gemini response.
+type Header struct {
+	Status int
+	Meta   string
+}
+
+// Returns an error if the header is not a valid Gemini status line.
+func (h Header) Validate() error {
+	if h.Status < 10 || h.Status > 69 {
+		return fmt.Errorf("Invalid status code %d.", h.Status)
+	}
+
+	if len(h.Meta) > maxMetaLength {
+		return fmt.Errorf("Meta is longer than %d bytes.", maxMetaLength)
+	}
+
+	if strings.ContainsAny(h.Meta, "\r\n") {
+		return fmt.Errorf("Meta contains a line break.")
+	}
+
+	return nil
+}
+
+// Returns the header formatted as a status line, including the final CRLF.
+func (h Header) String() string {
+	return fmt.Sprintf("%d %s\r\n", h.Status, h.Meta)
+}
+
+// Parses a status line, with or without the final line break, and validates
+// it.
+func ParseHeader(line string) (h Header, err error) {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	statusStr, meta, _ := strings.Cut(line, " ")
+	h.Status, err = strconv.Atoi(statusStr)
+	if err != nil || len(statusStr) != 2 {
+		err = fmt.Errorf("Invalid status line: %q", line)
+		return
+	}
+
+	h.Meta = meta
+	err = h.Validate()
+	return
+}
+
+// Reads and parses a status line from the reader, which should have a buffer
+// large enough for a complete status line.
+func readHeader(r *bufio.Reader) (h Header, err error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || (err == nil && len(line) > maxHeaderLength) {
+		err = fmt.Errorf("Status line is too long.")
+		return
+	} else if err != nil {
+		err = fmt.Errorf("Could not read status line: %s", err)
+		return
+	}
+
+	return ParseHeader(string(line))
+}
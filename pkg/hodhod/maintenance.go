@@ -0,0 +1,207 @@
+package hodhod
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultMaintenanceMessage = "Down for maintenance"
+
+// Maintenance entries enabled through the admin socket, keyed by hostname (an
+// empty hostname being the global entry). These are in addition to the ones
+// enabled by their flag files.
+var adminMaintenance = struct {
+	sync.Mutex
+	enabled map[string]bool
+}{
+	enabled: map[string]bool{},
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of a certificate, in the format
+// expected in the bypass_certs list.
+func CertFingerprint(certDer []byte) string {
+	sum := sha256.Sum256(certDer)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+func (m *MaintenanceConfig) isActive() bool {
+	adminMaintenance.Lock()
+	enabled := adminMaintenance.enabled[m.Hostname]
+	adminMaintenance.Unlock()
+	if enabled {
+		return true
+	}
+
+	if m.FlagFile == "" {
+		return false
+	}
+
+	_, err := os.Stat(m.FlagFile)
+	return err == nil
+}
+
+func (m *MaintenanceConfig) canBypass(req *Request) bool {
+	if req.ClientCert == nil {
+		return false
+	}
+
+	fingerprint := CertFingerprint(req.ClientCert.Raw)
+	for _, allowed := range m.BypassCerts {
+		if normalizeFingerprint(allowed) == fingerprint {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a response with a 41 status if the request is affected by an active
+// maintenance entry, or nil if it should be handled normally.
+func CheckMaintenance(req *Request, cfg *Config) Response {
+	hostname := req.Url.Hostname()
+	for i := range cfg.Maintenance {
+		m := &cfg.Maintenance[i]
+		if m.Hostname != "" && m.Hostname != hostname {
+			continue
+		}
+
+		if !m.isActive() || m.canBypass(req) {
+			continue
+		}
+
+		return NewStatusResp(41, m.Message)
+	}
+
+	return nil
+}
+
+func runAdminCommand(line string, cfg *Config) (reply string) {
+	args := strings.Fields(line)
+	if len(args) < 2 || args[0] != "maintenance" {
+		return "error: unknown command; expected 'maintenance on|off|status [hostname]'"
+	}
+
+	hostname := ""
+	if len(args) > 2 {
+		hostname = args[2]
+	}
+
+	var entry *MaintenanceConfig
+	for i := range cfg.Maintenance {
+		if cfg.Maintenance[i].Hostname == hostname {
+			entry = &cfg.Maintenance[i]
+			break
+		}
+	}
+	if entry == nil {
+		return fmt.Sprintf("error: no maintenance entry for hostname '%s'", hostname)
+	}
+
+	switch args[1] {
+	case "on":
+		adminMaintenance.Lock()
+		adminMaintenance.enabled[hostname] = true
+		adminMaintenance.Unlock()
+		log.Printf("Maintenance mode enabled through admin socket (hostname: '%s')\n", hostname)
+		return "ok"
+	case "off":
+		adminMaintenance.Lock()
+		delete(adminMaintenance.enabled, hostname)
+		adminMaintenance.Unlock()
+		log.Printf("Maintenance mode disabled through admin socket (hostname: '%s')\n", hostname)
+		return "ok"
+	case "status":
+		if entry.isActive() {
+			return "on"
+		}
+		return "off"
+	default:
+		return fmt.Sprintf("error: unknown maintenance command '%s'", args[1])
+	}
+}
+
+func handleAdminConn(conn net.Conn, cfg *Config) {
+	defer conn.Close()
+
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		reply := runAdminCommand(s.Text(), cfg)
+		_, err := io.WriteString(conn, reply+"\n")
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Listens on the admin unix socket configured in admin_socket and runs the
+// commands received on it. Each line received is a command, and a one-line reply
+// is sent back for each.
+func ServeAdmin(cfg *Config) (err error) {
+	// remove the socket file possibly left over from a previous run, but
+	// nothing else that happens to be at the same path.
+	info, err := os.Lstat(cfg.AdminSocket)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("Admin socket path exists and is not a socket: %s", cfg.AdminSocket)
+		}
+
+		err = os.Remove(cfg.AdminSocket)
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// the socket is created in a private directory, and only moved into place
+	// after its permissions are set, so that nobody else can connect to it in
+	// the meantime.
+	dir, err := os.MkdirTemp(filepath.Dir(cfg.AdminSocket), ".hodhod-admin-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, cfg.AdminSocket)
+	}
+	if err != nil {
+		listener.Close()
+		return
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("Error accepting admin connection:", err)
+				return
+			}
+
+			go handleAdminConn(conn, cfg)
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,215 @@
+package hodhod
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single line of a metadata file, setting the metadata of the files in the
+// same directory matching a glob pattern. Only one of ContentType, Params and
+// StatusCode is set.
+type MetaRule struct {
+	Glob string
+
+	// Replaces the content type of the file
+	ContentType string
+
+	// Parameters to add to the content type of the file (e.g. ";lang=fa")
+	Params string
+
+	// Instead of the file, a response with this status code and meta is sent
+	StatusCode int
+	Meta       string
+}
+
+type metaFile struct {
+	modTime time.Time
+	size    int64
+	rules   []MetaRule
+}
+
+// Parsed metadata files, keyed by their path, so that we don't need to parse
+// them on every request. Entries are re-read when the file changes.
+var metaCache = struct {
+	sync.Mutex
+	files map[string]*metaFile
+}{
+	files: map[string]*metaFile{},
+}
+
+// Parses a metadata file. Each non-empty line that does not start with a '#'
+// contains a glob pattern, a colon and the metadata for the files matching the
+// pattern. The metadata can be one of:
+//
+//   - a content type, e.g. "text/plain; charset=utf-8"
+//   - parameters added to the detected content type, e.g. ";lang=fa"
+//   - a non-success status code and its meta, e.g. "52 This page is gone" or
+//     "31 gemini://example.org/new-page"
+func parseMetaFile(f *os.File) (rules []MetaRule, err error) {
+	s := bufio.NewScanner(f)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		glob, value, ok := strings.Cut(line, ":")
+		if !ok {
+			err = fmt.Errorf("Missing colon in line %d of %s", lineNo, f.Name())
+			return
+		}
+
+		rule := MetaRule{
+			Glob: strings.TrimSpace(glob),
+		}
+		if _, err = filepath.Match(rule.Glob, ""); err != nil {
+			err = fmt.Errorf("Bad pattern in line %d of %s: %s", lineNo, f.Name(), err)
+			return
+		}
+
+		value = strings.TrimSpace(value)
+		statusStr, meta, _ := strings.Cut(value, " ")
+		statusCode, serr := strconv.Atoi(statusStr)
+		switch {
+		case strings.HasPrefix(value, ";"):
+			rule.Params = value
+		case serr == nil && len(statusStr) == 2:
+			if statusCode < 10 || statusCode > 69 || statusCode/10 == 2 {
+				err = fmt.Errorf("Invalid status code in line %d of %s", lineNo, f.Name())
+				return
+			}
+			rule.StatusCode = statusCode
+			rule.Meta = strings.TrimSpace(meta)
+		case value != "":
+			rule.ContentType = value
+		default:
+			err = fmt.Errorf("Empty metadata in line %d of %s", lineNo, f.Name())
+			return
+		}
+
+		rules = append(rules, rule)
+	}
+
+	err = s.Err()
+	return
+}
+
+// Returns the rules in the given open metadata file, reading it only if it has
+// changed since the last time it was read from the same path.
+func getMetaRules(f *os.File, metaPath string) (rules []MetaRule, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	metaCache.Lock()
+	cached, ok := metaCache.files[metaPath]
+	metaCache.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.rules, nil
+	}
+
+	rules, err = parseMetaFile(f)
+	if err != nil {
+		return
+	}
+
+	metaCache.Lock()
+	metaCache.files[metaPath] = &metaFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		rules:   rules,
+	}
+	metaCache.Unlock()
+
+	return
+}
+
+// Finds the first rule matching one of the given file names in the metadata
+// file of the directory containing them. All the names should be in the same
+// directory, which should be inside the backend location. Returns nil if there
+// is no matching rule.
+func lookupMeta(backend *Backend, filenames ...string) *MetaRule {
+	if backend.MetaFile == "" || len(filenames) == 0 {
+		return nil
+	}
+
+	metaPath := filepath.Join(filepath.Dir(filenames[0]), backend.MetaFile)
+	f, err := openConfined(metaPath, backend)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Println("Error reading metadata file:", err)
+		return nil
+	}
+	defer f.Close()
+
+	rules, err := getMetaRules(f, f.Name())
+	if err != nil {
+		log.Println("Error reading metadata file:", err)
+		return nil
+	}
+
+	for _, rule := range rules {
+		for _, filename := range filenames {
+			matched, _ := filepath.Match(rule.Glob, filepath.Base(filename))
+			if matched {
+				return &rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// Applies the rule to the given content type.
+func (rule *MetaRule) apply(contentType string) string {
+	if rule.ContentType != "" {
+		return rule.ContentType
+	}
+
+	if rule.Params == "" {
+		return contentType
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	_, extraParams, err := mime.ParseMediaType("x/x" + rule.Params)
+	if err != nil {
+		return contentType
+	}
+
+	for k, v := range extraParams {
+		params[k] = v
+	}
+
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// Returns the response for a rule with a status code.
+func (rule *MetaRule) response() Response {
+	switch rule.StatusCode {
+	case 30:
+		return NewTempRedirectResp(rule.Meta)
+	case 31:
+		return NewPermRedirectResp(rule.Meta)
+	default:
+		return &ErrorResponse{
+			StatusCode: rule.StatusCode,
+			Meta:       rule.Meta,
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package hodhod
+
+import "os"
+
+// File ownership is not supported on this platform, so user directories can
+// never be served.
+func fileOwner(info os.FileInfo) (uid string, ok bool) {
+	return
+}
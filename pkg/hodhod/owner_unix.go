@@ -0,0 +1,20 @@
+//go:build unix
+
+package hodhod
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Returns the user id of the owner of the file described by info.
+func fileOwner(info os.FileInfo) (uid string, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	uid = strconv.FormatUint(uint64(stat.Uid), 10)
+	return
+}
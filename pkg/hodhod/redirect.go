@@ -1,14 +1,8 @@
 package hodhod
 
-import (
-	"fmt"
-	"io"
-)
-
 type RedirectResponse struct {
-	StatusCode         int
-	Target             string
-	returnedStatusLine bool
+	StatusCode int
+	Target     string
 }
 
 func (resp *RedirectResponse) Backend() string {
@@ -19,19 +13,8 @@ func (resp *RedirectResponse) Init(req *Request) (err error) {
 	return
 }
 
-func (resp *RedirectResponse) Read(p []byte) (n int, err error) {
-	if resp.returnedStatusLine {
-		return 0, io.EOF
-	}
-
-	status := []byte(fmt.Sprintf("%d %s\r\n", resp.StatusCode, resp.Target))
-	if len(p) < len(status) {
-		return 0, fmt.Errorf("Not enough space in read buffer")
-	}
-	copy(p, status)
-
-	n = len(status)
-	resp.returnedStatusLine = true
+func (resp *RedirectResponse) Send(w ResponseWriter) (err error) {
+	w.WriteHeader(resp.StatusCode, resp.Target)
 	return
 }
 
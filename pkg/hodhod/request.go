@@ -1,8 +1,69 @@
 package hodhod
 
-import "net/url"
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/url"
+)
 
 type Request struct {
+	Id         string
 	Url        *url.URL
 	RemoteAddr string
+	ClientCert *x509.Certificate
+
+	// The server name sent by the client in the TLS handshake
+	Sni string
+
+	// State of the TLS connection the request was received on
+	TLS *tls.ConnectionState
+
+	// The route matching the request and its backend, set once the request
+	// has been routed
+	Route   *Route
+	Backend *Backend
+
+	ctx context.Context
+}
+
+type requestContextKey struct{}
+
+// Returns the context of the request, which is cancelled when the client
+// disconnects, the connection times out, or the server is shut down. The
+// cause of the cancellation can be found using context.Cause.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+
+	return req.ctx
+}
+
+// Returns a copy of the request with its context changed to ctx. The returned
+// request can be retrieved from the new context using RequestFromContext.
+func (req *Request) WithContext(ctx context.Context) *Request {
+	r := *req
+	r.ctx = context.WithValue(ctx, requestContextKey{}, &r)
+	return &r
+}
+
+// Returns the request a context belongs to, or nil if it does not belong to
+// any.
+func RequestFromContext(ctx context.Context) *Request {
+	req, _ := ctx.Value(requestContextKey{}).(*Request)
+	return req
+}
+
+// Returns a random id used to identify a request in the logs.
+func NewRequestId() string {
+	buf := make([]byte, 6)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(buf)
 }
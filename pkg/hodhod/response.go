@@ -1,16 +1,14 @@
 package hodhod
 
-import (
-	"io"
-)
-
 type Response interface {
-	// Called before response body is read, in order to perform any needed
+	// Called before the response is sent, in order to perform any needed
 	// initialization.
 	Init(req *Request) (err error)
 
-	// Read a part of the response body. Implementes the io.Reader interface.
-	Read(p []byte) (n int, err error)
+	// Sends the response, i.e. the header and then the body if there is one,
+	// through the given writer. Returning an error aborts the connection, so
+	// that the client can tell the response is incomplete.
+	Send(w ResponseWriter) (err error)
 
 	// Release any resources related to this response
 	Close()
@@ -19,4 +17,23 @@ type Response interface {
 	Backend() string
 }
 
-var _ io.Reader = Response(nil)
+// Used for sending a response. This is what handlers and responses write into,
+// and middleware can wrap it to inspect or change the header of a response.
+type ResponseWriter interface {
+	// Sends the header of the response. This should be called exactly once,
+	// before any call to Write. If the header is not valid, a 40 status is
+	// sent instead.
+	WriteHeader(statusCode int, meta string)
+
+	// Writes a part of the response body.
+	Write(p []byte) (n int, err error)
+}
+
+// Implemented by responses that might need to be streamed to the client as they
+// are produced, instead of being buffered.
+type StreamingResponse interface {
+	Response
+
+	// Returns true if the response should be streamed
+	Streaming() bool
+}
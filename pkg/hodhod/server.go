@@ -0,0 +1,595 @@
+package hodhod
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// This is the amount specified by the Gemini spec
+	GeminiMaxRequestSize = 1024
+)
+
+// Returned by the Serve and ListenAndServe methods of a Server after it has
+// been shut down.
+var ErrServerClosed = errors.New("Server closed")
+
+type ErrNotFound struct {
+	Reason string
+	Url    string
+}
+
+type ErrInvalidUrl struct {
+	Reason string
+	Url    string
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("URL %s not found: %s", e.Url, e.Reason)
+}
+
+func (e ErrNotFound) Is(err error) bool {
+	_, ok := err.(ErrNotFound)
+	return ok
+}
+
+func (e ErrInvalidUrl) Error() string {
+	return fmt.Sprintf("URL %s is not valid: %s", e.Url, e.Reason)
+}
+
+func (e ErrInvalidUrl) Is(err error) bool {
+	_, ok := err.(ErrInvalidUrl)
+	return ok
+}
+
+var _ error = (*ErrNotFound)(nil)
+var _ error = (*ErrInvalidUrl)(nil)
+
+func errNotFound(url string, reason string) ErrNotFound {
+	return ErrNotFound{
+		Url:    url,
+		Reason: reason,
+	}
+}
+
+func errInvalidUrl(url string, reason string) ErrInvalidUrl {
+	return ErrInvalidUrl{
+		Url:    url,
+		Reason: reason,
+	}
+}
+
+var errResponseTooLarge = errors.New("Response size limit exceeded")
+
+// A writer for sending the response to the client, which makes sure each write
+// completes within the idle write timeout, and aborts the response if it goes
+// over the maximum response size.
+type connWriter struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	maxSize     int64
+	written     int64
+}
+
+func (w *connWriter) Write(p []byte) (n int, err error) {
+	if w.maxSize > 0 && w.written+int64(len(p)) > w.maxSize {
+		return 0, errResponseTooLarge
+	}
+
+	err = w.conn.SetWriteDeadline(time.Now().Add(w.idleTimeout))
+	if err != nil {
+		return
+	}
+
+	n, err = w.conn.Write(p)
+	w.written += int64(n)
+	return
+}
+
+var errNoHeader = errors.New("Response body written before the header")
+var errClientGone = errors.New("Client has gone away")
+var errTotalTimeout = errors.New("Connection total timeout reached")
+
+// The ResponseWriter responses are sent through, making sure a single valid
+// header is sent before the body.
+type connResponseWriter struct {
+	out         io.Writer
+	req         *Request
+	wroteHeader bool
+
+	// set when the header sent by the response was invalid, and a 40 status
+	// was sent instead; the body is then discarded.
+	invalidHeader bool
+
+	// the first error returned from writing to the connection
+	err error
+}
+
+func (w *connResponseWriter) WriteHeader(statusCode int, meta string) {
+	if w.wroteHeader {
+		log.Printf("Response header sent more than once (id=%s).\n", w.req.Id)
+		return
+	}
+	w.wroteHeader = true
+
+	header := Header{
+		Status: statusCode,
+		Meta:   meta,
+	}
+	err := header.Validate()
+	if err != nil {
+		log.Printf("Invalid response header (id=%s): %s\n", w.req.Id, err)
+		w.invalidHeader = true
+		header = Header{
+			Status: 40,
+			Meta:   "Internal error",
+		}
+	}
+
+	_, err = io.WriteString(w.out, header.String())
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *connResponseWriter) Write(p []byte) (n int, err error) {
+	ctx := w.req.Context()
+	switch {
+	case w.err != nil:
+		return 0, w.err
+	case ctx.Err() != nil:
+		// the request has been cancelled, so there's no point in sending the
+		// rest of the response.
+		return 0, context.Cause(ctx)
+	case !w.wroteHeader:
+		return 0, errNoHeader
+	case w.invalidHeader:
+		return len(p), nil
+	}
+
+	n, err = w.out.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return
+}
+
+// A Gemini server serving the routes and backends in a config. This is what the
+// hodhod command runs, and can be used to embed hodhod in other programs.
+type Server struct {
+	Config *Config
+
+	tlsConfig *tls.Config
+
+	// the parent of the contexts of all requests, cancelled when the server is
+	// forcefully shut down.
+	baseCtx    context.Context
+	cancelBase context.CancelCauseFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+
+	// the active connections, and the underlying network connection of each,
+	// which is closed to abort them on shutdown.
+	conns   map[*tls.Conn]net.Conn
+	connsWg sync.WaitGroup
+}
+
+// Creates a server for the given config, which should have been returned by
+// LoadConfig, or prepared using its Prepare method. The certificates in the
+// config are loaded right away.
+func NewServer(cfg *Config) (srv *Server, err error) {
+	certs, err := loadCertificates(cfg)
+	if err != nil {
+		return
+	}
+
+	baseCtx, cancelBase := context.WithCancelCause(context.Background())
+	srv = &Server{
+		Config:     cfg,
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+		tlsConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: certs,
+
+			// client certificates are not verified, since in Gemini they are
+			// usually self-signed and only used to identify clients.
+			ClientAuth: tls.RequestClientCert,
+		},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[*tls.Conn]net.Conn{},
+	}
+	return
+}
+
+// Listens on the address in the listen option of the config, and serves
+// connections until ctx is cancelled or the server is shut down, after which
+// ErrServerClosed is returned. Cancelling ctx stops accepting new connections,
+// but does not wait for the active ones; use Shutdown for that.
+func (srv *Server) ListenAndServe(ctx context.Context) (err error) {
+	listener, err := net.Listen("tcp", srv.Config.ListenAddr)
+	if err != nil {
+		return
+	}
+
+	log.Println("Started listening at:", srv.Config.ListenAddr)
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.close()
+		case <-stopped:
+		}
+	}()
+
+	return srv.Serve(listener)
+}
+
+// Accepts connections on the given listener and serves them, until the server
+// is shut down. The listener should not do TLS itself; that is handled by the
+// server, using the certificates in the config.
+func (srv *Server) Serve(listener net.Listener) (err error) {
+	listener = tls.NewListener(listener, srv.tlsConfig)
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[listener] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, listener)
+		srv.mu.Unlock()
+		listener.Close()
+	}()
+
+	for {
+		conn, aerr := listener.Accept()
+		if aerr != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+
+			return aerr
+		}
+
+		tlsConn := conn.(*tls.Conn)
+
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		srv.conns[tlsConn] = tlsConn.NetConn()
+		srv.connsWg.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer func() {
+				srv.mu.Lock()
+				delete(srv.conns, tlsConn)
+				srv.mu.Unlock()
+				srv.connsWg.Done()
+			}()
+
+			srv.handleConn(tlsConn)
+		}()
+	}
+}
+
+// Stops accepting new connections.
+func (srv *Server) close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+	for listener := range srv.listeners {
+		listener.Close()
+	}
+}
+
+// Stops accepting new connections, and waits for the active ones to finish. If
+// ctx is done before that, the remaining connections are aborted, and the error
+// from ctx is returned.
+func (srv *Server) Shutdown(ctx context.Context) (err error) {
+	srv.close()
+
+	done := make(chan struct{})
+	go func() {
+		srv.connsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.cancelBase(ErrServerClosed)
+
+		srv.mu.Lock()
+		for _, netConn := range srv.conns {
+			netConn.Close()
+		}
+		srv.mu.Unlock()
+
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Routes the request, setting its Route and Backend fields, and returns the
+// response to it.
+func getResponseForRequest(req *Request, cfg *Config) (resp Response, backend *Backend, err error) {
+	if req.Url.Scheme != "gemini" {
+		err = errInvalidUrl(req.Url.String(), fmt.Sprintf("Invalid URL scheme (%s)", req.Url.Scheme))
+		return
+	}
+
+	route, backend, unmatched := cfg.MatchRoute(*req.Url)
+	if backend == nil {
+		resp = NewNotFoundPageResp(nil, req, cfg)
+		if resp == nil {
+			err = errNotFound(req.Url.String(), "no route")
+		}
+		return
+	}
+
+	req.Route = route
+	req.Backend = backend
+
+	resp = CheckMaintenance(req, cfg)
+	if resp != nil {
+		return
+	}
+
+	backendType, ok := lookupBackendType(backend.Type)
+	if !ok {
+		err = fmt.Errorf("Unknown backend type: %s", backend.Type)
+		return
+	}
+
+	resp = backendType.NewResponse(backend, unmatched, *req, cfg)
+	return
+}
+
+func (srv *Server) handleConn(tlsConn *tls.Conn) {
+	defer tlsConn.Close()
+
+	cfg := srv.Config
+	var conn net.Conn = tlsConn
+
+	// the context of the request; cancelled when the connection is done one
+	// way or another.
+	ctx, cancel := context.WithCancelCause(srv.baseCtx)
+	defer cancel(nil)
+
+	var totalTimer *time.Timer
+	if cfg.Timeouts.Total > 0 {
+		totalTimer = time.AfterFunc(time.Duration(cfg.Timeouts.Total)*time.Second, func() {
+			log.Println("Connection total timeout reached; closing:", conn.RemoteAddr().String())
+			cancel(errTotalTimeout)
+			tlsConn.NetConn().Close()
+		})
+		defer totalTimer.Stop()
+	}
+
+	err := conn.SetDeadline(time.Now().Add(time.Duration(cfg.Timeouts.Handshake) * time.Second))
+	if err != nil {
+		log.Println("Error setting connection deadline:", err)
+		return
+	}
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		log.Println("TLS handshake error:", err)
+		return
+	}
+
+	err = conn.SetDeadline(time.Now().Add(time.Duration(cfg.Timeouts.RequestRead) * time.Second))
+	if err != nil {
+		log.Println("Error setting connection deadline:", err)
+		return
+	}
+
+	buf := make([]byte, GeminiMaxRequestSize)
+	s := bufio.NewScanner(conn)
+	s.Buffer(buf, GeminiMaxRequestSize)
+	ok := s.Scan()
+	if !ok {
+		log.Println("Could not read request:", s.Err())
+		return
+	}
+
+	sni := tlsConn.ConnectionState().ServerName
+
+	urlStr := s.Text()
+	urlParsed, err := url.Parse(urlStr)
+	if err != nil {
+		log.Printf("Request: remote=%s sni=%s resp=59 url=%s\n", conn.RemoteAddr().String(), sni, urlStr)
+		conn.Write([]byte("59 Bad Request\r\n"))
+		return
+	}
+
+	if sni != urlParsed.Hostname() {
+		log.Printf("Request: remote=%s sni=%s resp=53 url=%s\n", conn.RemoteAddr().String(), sni, urlStr)
+		conn.Write([]byte("53 URL hostname does not match SNI\r\n"))
+		return
+	}
+
+	tlsState := tlsConn.ConnectionState()
+	req := (&Request{
+		Id:         NewRequestId(),
+		Url:        urlParsed,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Sni:        sni,
+		TLS:        &tlsState,
+	}).WithContext(ctx)
+	if len(tlsState.PeerCertificates) > 0 {
+		req.ClientCert = tlsState.PeerCertificates[0]
+	}
+	resp, backend, err := getResponseForRequest(req, cfg)
+	if errors.Is(err, ErrNotFound{}) {
+		log.Printf("Request: id=%s remote=%s backend=none sni=%s resp=51 url=%s %s\n", req.Id, conn.RemoteAddr().String(), sni, urlStr, err)
+		conn.Write([]byte("51 Not Found\r\n"))
+		return
+	} else if errors.Is(err, ErrInvalidUrl{}) {
+		log.Printf("Request: id=%s remote=%s backend=none sni=%s resp=59 url=%s %s\n", req.Id, conn.RemoteAddr().String(), sni, urlStr, err)
+		conn.Write([]byte("59 Bad Request\r\n"))
+		return
+	} else if err != nil {
+		log.Println("Could not find response for the request:", err)
+		return
+	}
+
+	log.Printf("Request: id=%s remote=%s backend=%s url=%s\n", req.Id, conn.RemoteAddr().String(), resp.Backend(), urlStr)
+
+	err = resp.Init(req)
+	if err != nil {
+		log.Printf("Request: id=%s remote=%s resp=40 url=%s\n", req.Id, conn.RemoteAddr().String(), urlStr)
+		conn.Write([]byte("40 Internal error\r\n"))
+		return
+	}
+
+	// the request has been read; from now on, only the writes are subject to
+	// the idle write timeout.
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Println("Error setting connection deadline:", err)
+		return
+	}
+
+	w := &connWriter{
+		conn:        conn,
+		idleTimeout: time.Duration(cfg.Timeouts.IdleWrite) * time.Second,
+	}
+	if backend != nil {
+		w.maxSize = backend.MaxResponseSize
+	}
+
+	streamingResp, streaming := resp.(StreamingResponse)
+	streaming = streaming && streamingResp.Streaming()
+	if streaming && totalTimer != nil {
+		// streamed responses can be long-lived, and are only subject to the
+		// idle timeouts.
+		totalTimer.Stop()
+	}
+
+	// unless streaming, the response is buffered so that we don't send a tiny
+	// TLS record for every little chunk the backend produces.
+	var out io.Writer = w
+	var bufOut *bufio.Writer
+	if !streaming {
+		bufOut = bufio.NewWriter(w)
+		out = bufOut
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer resp.Close()
+		rw := &connResponseWriter{
+			out: out,
+			req: req,
+		}
+		err := resp.Send(rw)
+		if err == nil && rw.err != nil {
+			err = rw.err
+		} else if err == nil && !rw.wroteHeader {
+			err = fmt.Errorf("Response has no header")
+		}
+		if bufOut != nil {
+			// even if there was an error, whatever we have should be sent
+			// before aborting the connection.
+			ferr := bufOut.Flush()
+			if err == nil {
+				err = ferr
+			}
+		}
+
+		// give the client some time to close the connection after receiving
+		// the response, but not forever.
+		conn.SetReadDeadline(time.Now().Add(w.idleTimeout))
+
+		if err != nil {
+			log.Println("Error sending response:", err)
+
+			// close the underlying connection (instead of letting the tls
+			// connection to be properly closed) to signal to the client that
+			// there was an error.
+			tlsConn.NetConn().Close()
+		} else if tcpConn, ok := tlsConn.NetConn().(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		// the client should not send any more bytes; if we receive anything,
+		// that's an error, and we'll close the connection.
+		buf := make([]byte, 1)
+		n, err := conn.Read(buf)
+
+		// this is how we find out the client has gone away, and there's no
+		// point in producing the rest of the response. gemini clients never
+		// close their side of the connection while waiting for a response, so
+		// an EOF means the same.
+		cancel(errClientGone)
+
+		if n != 0 {
+			log.Println("Unexpected input from client.")
+			conn.Close()
+		} else if err != nil && err != io.EOF {
+			conn.Close()
+		}
+
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
+
+func loadCertificates(cfg *Config) (certs []tls.Certificate, err error) {
+	certs = make([]tls.Certificate, len(cfg.Certs))
+	for i, c := range cfg.Certs {
+		certs[i], err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return
+		}
+
+		// the documentation for the `Certificates` field of `tls.Config` says
+		// that if the optional Leaf field is not set, and there are multiple
+		// certificates, there will be a significant pre-handshake cost (because
+		// the certificate needs to be parsed every time). Here, we parse the
+		// leaf certificate and store it in the Leaf field so that this will not
+		// happen.
+		certs[i].Leaf, err = x509.ParseCertificate(certs[i].Certificate[0])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
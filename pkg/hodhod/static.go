@@ -1,16 +1,24 @@
 package hodhod
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 type StaticResponse struct {
-	file               *os.File
-	contentType        string
-	returnedStatusLine bool
+	file *os.File
+
+	// either the file itself, or its cached contents
+	body io.Reader
+
+	contentType string
 }
 
 func (resp *StaticResponse) Backend() string {
@@ -21,43 +29,261 @@ func (resp *StaticResponse) Init(req *Request) (err error) {
 	return
 }
 
-func (resp *StaticResponse) Read(p []byte) (n int, err error) {
-	if !resp.returnedStatusLine {
-		status := []byte(fmt.Sprintf("20 %s\r\n", resp.contentType))
-		if len(p) < len(status) {
-			return 0, fmt.Errorf("Not enough space in read buffer")
+func (resp *StaticResponse) Send(w ResponseWriter) (err error) {
+	w.WriteHeader(20, resp.contentType)
+	_, err = io.Copy(w, resp.body)
+	return
+}
+
+func (resp *StaticResponse) Close() {
+	if resp.file != nil {
+		resp.file.Close()
+	}
+}
+
+// Detects the content type of a file with an unknown extension by looking at
+// its first few bytes. Text files are assumed to have the given default content
+// type, so that extensionless gemtext files still work as expected.
+func sniffContentType(f io.ReadSeeker, defaultType string) string {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return defaultType
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return defaultType
+	}
+
+	if n == 0 {
+		return defaultType
+	}
+
+	contentType := http.DetectContentType(buf[:n])
+	if strings.HasPrefix(contentType, "text/plain") {
+		return defaultType
+	}
+
+	return contentType
+}
+
+// Adds lang and charset parameters configured for the backend, or the directory
+// containing the file, to a text content type. The file name should be
+// slash-separated and relative to the backend location. Parameters already
+// present in the content type are left alone.
+func addTextParams(contentType string, backend *Backend, rel string) string {
+	if !strings.HasPrefix(contentType, "text/") {
+		return contentType
+	}
+
+	// each parameter is taken from the most specific directory that sets it,
+	// falling back to the backend-wide value.
+	lang := backend.Lang
+	charset := backend.Charset
+	langDirLen := -1
+	charsetDirLen := -1
+	for _, params := range backend.DirParams {
+		dir := strings.Trim(path.Clean("/"+params.Dir), "/")
+		if dir != "" && rel != dir && !strings.HasPrefix(rel, dir+"/") {
+			continue
+		}
+
+		if params.Lang != "" && len(dir) > langDirLen {
+			lang = params.Lang
+			langDirLen = len(dir)
+		}
+		if params.Charset != "" && len(dir) > charsetDirLen {
+			charset = params.Charset
+			charsetDirLen = len(dir)
 		}
-		copy(p, status)
-		resp.returnedStatusLine = true
-		n = len(status)
+	}
+
+	if lang == "" && charset == "" {
+		return contentType
+	}
+
+	mediaType, mediaParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	if _, ok := mediaParams["lang"]; !ok && lang != "" {
+		mediaParams["lang"] = lang
+	}
+	if _, ok := mediaParams["charset"]; !ok && charset != "" {
+		mediaParams["charset"] = charset
+	}
+
+	return mime.FormatMediaType(mediaType, mediaParams)
+}
+
+// Returns true if any of the segments in the given slash-separated path starts
+// with a dot.
+func hasDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if p is the same as root, or is a path inside it. Both paths are
+// expected to be clean and absolute.
+func isWithin(root string, p string) bool {
+	if p == root {
+		return true
+	}
+
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+
+	return strings.HasPrefix(p, root)
+}
+
+// Resolves symbolic links in the given file name (which should be lexically
+// inside the backend location), making sure that doing so does not take us
+// anywhere the follow_symlinks option of the backend does not allow.
+func resolveConfined(filename string, backend *Backend) (resolved string, err error) {
+	if backend.FollowSymlinks == "always" {
+		return filename, nil
+	}
+
+	root, err := filepath.EvalSymlinks(backend.Location)
+	if err != nil {
 		return
 	}
 
-	return resp.file.Read(p)
+	resolved, err = filepath.EvalSymlinks(filename)
+	if err != nil {
+		return
+	}
+
+	rel, err := filepath.Rel(backend.Location, filename)
+	if err != nil {
+		return
+	}
+
+	switch backend.FollowSymlinks {
+	case "never":
+		if resolved != filepath.Join(root, rel) {
+			err = fmt.Errorf("Path contains a symlink: %s", filename)
+		}
+	case "within":
+		if !isWithin(root, resolved) {
+			err = fmt.Errorf("Symlink points outside backend location: %s", filename)
+		}
+	}
+
+	return
 }
 
-func (resp *StaticResponse) Close() {
-	if resp.file != nil {
-		resp.file.Close()
+// Opens the given file after resolving it using resolveConfined. The path can
+// change between resolving and opening it (e.g. a directory can be replaced
+// with a symlink), so the file that was actually opened is checked again.
+func openConfined(filename string, backend *Backend) (f *os.File, err error) {
+	resolved, err := resolveConfined(filename, backend)
+	if err != nil {
+		return
+	}
+
+	f, err = os.Open(resolved)
+	if err != nil || backend.FollowSymlinks == "always" {
+		return
 	}
+
+	err = checkOpened(f, resolved)
+	if err != nil {
+		f.Close()
+		f = nil
+	}
+
+	return
 }
 
-func NewFileResp(filename string, req Request, cfg *Config) (resp Response) {
-	isDir := false
-	f, err := os.Open(filename)
+// Makes sure the given open file is the one at the resolved path, which
+// resolveConfined has already checked.
+func checkOpened(f *os.File, resolved string) (err error) {
+	opened, err := openedPath(f)
+	if err != nil {
+		// the path of an open file cannot always be found, so settle for
+		// making sure the resolved path leads to the same file.
+		return checkSameFile(f, resolved)
+	}
+
+	if opened != resolved {
+		err = fmt.Errorf("File changed while being opened: %s", resolved)
+	}
+
+	return
+}
+
+// Makes sure the resolved path has no symlinks in it, and leads to the given
+// open file.
+func checkSameFile(f *os.File, resolved string) (err error) {
+	openedInfo, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	p, err := filepath.EvalSymlinks(resolved)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return
+	}
+
+	if p != resolved || !os.SameFile(info, openedInfo) {
+		err = fmt.Errorf("File changed while being opened: %s", resolved)
+	}
+
+	return
+}
+
+// Returns the cleaned version of the unmatched part of a request path, or false
+// if it refers to a file a static backend should not serve.
+func staticRequestPath(backend *Backend, unmatched string) (reqPath string, ok bool) {
+	// cleaning the path as if it was rooted removes all ".." segments, so the
+	// resulting file name can never be outside the backend location.
+	reqPath = path.Clean("/" + unmatched)
+	if !backend.AllowDotfiles && hasDotSegment(reqPath) {
+		return
+	}
+
+	if path.Base(reqPath) == backend.MetaFile {
+		return
+	}
+
+	ok = true
+	return
+}
+
+// Opens the file a static backend serves for the given cleaned request path,
+// trying the index file if it is a directory, and the default extensions if it
+// does not exist.
+func openStaticFile(backend *Backend, reqPath string, cfg *Config) (f *os.File, filename string, isDir bool, err error) {
+	filename = filepath.Join(backend.Location, filepath.FromSlash(reqPath))
+	f, err = openCached(filename, backend, cfg)
 
 	if err == nil {
 		info, serr := f.Stat()
 		if serr == nil && info.IsDir() {
+			f.Close()
 			isDir = true
-			filename = path.Join(filename, cfg.MatchOptions.IndexFilename)
-			f, err = os.Open(filename)
+			filename = filepath.Join(filename, cfg.MatchOptions.IndexFilename)
+			f, err = openCached(filename, backend, cfg)
 		}
 	}
 
 	if err != nil {
 		for _, ext := range cfg.MatchOptions.DefaultExts {
-			f, err = os.Open(filename + "." + ext)
+			f, err = openCached(filename+"."+ext, backend, cfg)
 			if err == nil {
 				filename = filename + "." + ext
 				break
@@ -65,21 +291,154 @@ func NewFileResp(filename string, req Request, cfg *Config) (resp Response) {
 		}
 	}
 
+	return
+}
+
+// Describes how a request routed to a static, cgi_dir or userdir backend is
+// handled. Returned by ExplainFileRequest.
+type FileTarget struct {
+	// For userdir backends, the directory of the user the request is for
+	UserDir string
+
+	// The CGI script run for the request, if any. The rest of the fields are
+	// only set if there is no script.
+	Script *CgiScript
+
+	// The file served, if any, and whether it is the index file of the
+	// requested directory
+	Filename string
+	IsDir    bool
+
+	// The rule of the metadata file matching the file. If it has a status
+	// code, a response with that status is sent instead of the file.
+	Rule *MetaRule
+
+	// If set, the request is redirected here, to add or remove the trailing
+	// slash of the URL.
+	Redirect string
+}
+
+// Decides how a static backend handles a request. Returns an error if there is
+// no file to serve, unless a metadata rule sets the status of the response.
+// Unless the target has a status rule or a redirect, the returned file is open
+// and should be closed by the caller.
+func resolveStaticRequest(backend *Backend, unmatched string, req *Request, cfg *Config) (f *os.File, target FileTarget, err error) {
+	reqPath, ok := staticRequestPath(backend, unmatched)
+	if !ok {
+		err = fmt.Errorf("Dotfiles and meta files are not served.")
+		return
+	}
+
+	requested := filepath.Join(backend.Location, filepath.FromSlash(reqPath))
+	f, target.Filename, target.IsDir, err = openStaticFile(backend, reqPath, cfg)
+
 	if err != nil {
-		resp = &ErrorResponse{
-			StatusCode: 51,
-			Meta:       "Not Found",
+		target.Filename = ""
+
+		// the metadata file might still have something to say about a file
+		// that does not exist (e.g. that it is gone).
+		candidates := []string{requested}
+		for _, ext := range cfg.MatchOptions.DefaultExts {
+			candidates = append(candidates, requested+"."+ext)
+		}
+		rule := lookupMeta(backend, candidates...)
+		if rule != nil && rule.StatusCode != 0 {
+			target.Rule = rule
 		}
+
+		return
+	}
+
+	target.Rule = lookupMeta(backend, target.Filename)
+	if target.Rule != nil && target.Rule.StatusCode != 0 {
+		f.Close()
+		f = nil
 		return
 	}
 
 	u := *req.Url
-	if isDir && u.Path[len(u.Path)-1] != '/' {
+	if target.IsDir && !strings.HasSuffix(u.Path, "/") {
 		u.Path = u.Path + "/"
-		return NewPermRedirectResp(u.String())
-	} else if !isDir && u.Path[len(u.Path)-1] == '/' {
+		target.Redirect = u.String()
+	} else if !target.IsDir && strings.HasSuffix(u.Path, "/") {
 		u.Path = u.Path[:len(u.Path)-1]
-		return NewPermRedirectResp(u.String())
+		target.Redirect = u.String()
+	}
+	if target.Redirect != "" {
+		f.Close()
+		f = nil
+	}
+
+	return
+}
+
+// Returns how a request routed to the given static, cgi_dir or userdir backend
+// would be handled, without handling it. The error describes why the request
+// would get a 51 response, if it does for any reason other than a metadata
+// rule. Mostly useful for debugging routes.
+func ExplainFileRequest(backend *Backend, unmatched string, req Request, cfg *Config) (target FileTarget, err error) {
+	cgi := backend.Type == "cgi_dir"
+	if backend.Type == "userdir" {
+		userBackend, rest, uerr := userDirBackend(backend, unmatched, &req)
+		if uerr != nil {
+			err = uerr
+			return
+		}
+
+		backend = &userBackend
+		unmatched = rest
+		cgi = backend.Cgi
+		target.UserDir = backend.Location
+	}
+
+	if cgi {
+		script, forbidden := findCgiScript(backend, &req, unmatched)
+		if forbidden {
+			err = fmt.Errorf("Files that look like scripts, but are not executable, are not served.")
+			return
+		}
+
+		if script != nil {
+			target.Script = script
+			return
+		}
+	}
+
+	f, fileTarget, err := resolveStaticRequest(backend, unmatched, &req, cfg)
+	if f != nil {
+		f.Close()
+	}
+
+	fileTarget.UserDir = target.UserDir
+	target = fileTarget
+	return
+}
+
+func NewFileResp(backend *Backend, unmatched string, req Request, cfg *Config) (resp Response) {
+	notFound := &ErrorResponse{
+		StatusCode: 51,
+		Meta:       "Not Found",
+	}
+
+	f, target, err := resolveStaticRequest(backend, unmatched, &req, cfg)
+	rule := target.Rule
+	switch {
+	case rule != nil && rule.StatusCode != 0:
+		return rule.response()
+	case err != nil:
+		return notFound
+	case target.Redirect != "":
+		return NewPermRedirectResp(target.Redirect)
+	}
+
+	filename := target.Filename
+
+	var body io.ReadSeeker = f
+	data, ok := cachedContent(f, cfg)
+	if ok {
+		f.Close()
+		f = nil
+		body = bytes.NewReader(data)
 	}
 
 	ext := filepath.Ext(filename)
@@ -90,10 +449,23 @@ func NewFileResp(filename string, req Request, cfg *Config) (resp Response) {
 	contentType, ok := cfg.ContentType.ExtMap[ext]
 	if !ok {
 		contentType = cfg.ContentType.Default
+		if cfg.ContentType.Sniff {
+			contentType = sniffContentType(body, contentType)
+		}
+	}
+
+	rel, err := filepath.Rel(backend.Location, filename)
+	if err == nil {
+		contentType = addTextParams(contentType, backend, filepath.ToSlash(rel))
+	}
+
+	if rule != nil {
+		contentType = rule.apply(contentType)
 	}
 
 	resp = &StaticResponse{
 		file:        f,
+		body:        body,
 		contentType: contentType,
 	}
 	return
@@ -0,0 +1,137 @@
+package hodhod
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maximum number of failed lookups remembered at once
+const maxNegativeEntries = 10000
+
+type cachedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// Contents of small files served by static backends, keyed by their resolved
+// path, and the file names that recently could not be opened. Cached contents
+// are revalidated against the modification time and size of the file on every
+// request, and the least recently used ones are evicted when the total size
+// goes over static_cache.max_size.
+var staticCache = struct {
+	sync.Mutex
+	files    map[string]*list.Element
+	lru      *list.List
+	size     int64
+	negative map[string]time.Time
+}{
+	files:    map[string]*list.Element{},
+	lru:      list.New(),
+	negative: map[string]time.Time{},
+}
+
+// Opens the given file like openConfined, but fails right away if the same
+// lookup has failed in the last static_cache.negative_ttl seconds.
+func openCached(filename string, backend *Backend, cfg *Config) (f *os.File, err error) {
+	if cfg.StaticCache.MaxSize == 0 || cfg.StaticCache.NegativeTtl == 0 {
+		return openConfined(filename, backend)
+	}
+
+	// whether a lookup fails depends on the symlink policy of the backend too
+	key := backend.FollowSymlinks + "\x00" + filename
+	now := time.Now()
+
+	staticCache.Lock()
+	expires, ok := staticCache.negative[key]
+	staticCache.Unlock()
+	if ok && now.Before(expires) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err = openConfined(filename, backend)
+	if err == nil {
+		return
+	}
+
+	staticCache.Lock()
+	if len(staticCache.negative) >= maxNegativeEntries {
+		for k, expires := range staticCache.negative {
+			if !now.Before(expires) {
+				delete(staticCache.negative, k)
+			}
+		}
+		if len(staticCache.negative) >= maxNegativeEntries {
+			staticCache.negative = map[string]time.Time{}
+		}
+	}
+	staticCache.negative[key] = now.Add(time.Duration(cfg.StaticCache.NegativeTtl) * time.Second)
+	staticCache.Unlock()
+
+	return
+}
+
+// Returns the contents of the given open file from the cache, reading and
+// caching them if necessary. Returns false if the file should not be cached.
+func cachedContent(f *os.File, cfg *Config) (data []byte, ok bool) {
+	if cfg.StaticCache.MaxSize == 0 {
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if info.Size() > cfg.StaticCache.MaxFileSize || info.Size() > cfg.StaticCache.MaxSize {
+		return
+	}
+
+	staticCache.Lock()
+	if elem, found := staticCache.files[f.Name()]; found {
+		cached := elem.Value.(*cachedFile)
+		if cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			staticCache.lru.MoveToFront(elem)
+			staticCache.Unlock()
+			return cached.data, true
+		}
+	}
+	staticCache.Unlock()
+
+	// reading one more byte than expected tells us if the file has grown since
+	// we got its size.
+	data, err = io.ReadAll(io.LimitReader(f, info.Size()+1))
+	if err != nil || int64(len(data)) != info.Size() {
+		// let the caller serve the file directly instead
+		f.Seek(0, io.SeekStart)
+		return nil, false
+	}
+
+	staticCache.Lock()
+	defer staticCache.Unlock()
+
+	if elem, found := staticCache.files[f.Name()]; found {
+		staticCache.size -= elem.Value.(*cachedFile).size
+		staticCache.lru.Remove(elem)
+	}
+
+	staticCache.files[f.Name()] = staticCache.lru.PushFront(&cachedFile{
+		path:    f.Name(),
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		data:    data,
+	})
+	staticCache.size += info.Size()
+
+	for staticCache.size > cfg.StaticCache.MaxSize {
+		oldest := staticCache.lru.Back()
+		evicted := staticCache.lru.Remove(oldest).(*cachedFile)
+		delete(staticCache.files, evicted.path)
+		staticCache.size -= evicted.size
+	}
+
+	return data, true
+}
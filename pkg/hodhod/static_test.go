@@ -0,0 +1,248 @@
+package hodhod
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewFileRespConfinement(t *testing.T) {
+	root := t.TempDir()
+	location := filepath.Join(root, "location")
+
+	for _, name := range []string{"page.gmi", ".hidden", "a/.git/config", "sub/inner.gmi"} {
+		name = filepath.Join(location, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte("x"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url           string
+		allowDotfiles bool
+		want          string // empty if the file should not be served
+	}{
+		{url: "gemini://localhost/page.gmi", want: "page.gmi"},
+		{url: "gemini://localhost/sub/../page.gmi", want: "page.gmi"},
+		{url: "gemini://localhost/sub/inner.gmi", want: "sub/inner.gmi"},
+		{url: "gemini://localhost/../secret"},
+		{url: "gemini://localhost/sub/../../../secret"},
+		{url: "gemini://localhost/%2e%2e/secret"},
+		{url: "gemini://localhost/%2E%2E%2F%2e%2e%2fsecret"},
+		{url: "gemini://localhost/sub%2f..%2f..%2fsecret"},
+		{url: "gemini://localhost/..%5csecret"},
+		{url: "gemini://localhost/.hidden"},
+		{url: "gemini://localhost/%2ehidden"},
+		{url: "gemini://localhost/a/.git/config"},
+		{url: "gemini://localhost/.hidden", allowDotfiles: true, want: ".hidden"},
+	}
+
+	for _, test := range tests {
+		cfg := &Config{
+			MatchOptions: MatchOptionsConfig{
+				QueryParams:   "remove",
+				TrailingSlash: "ifpresent",
+				IndexFilename: "index.gmi",
+			},
+			Routes: []Route{{Hostname: "localhost", Backend: "static"}},
+			Backends: []Backend{{
+				Name:          "static",
+				Type:          "static",
+				Location:      location,
+				AllowDotfiles: test.allowDotfiles,
+			}},
+		}
+		setDefaultsAndNormalize(cfg)
+
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("Error parsing url %s: %s", test.url, err)
+		}
+
+		backend, unmatched := cfg.GetBackendByUrl(*u)
+		if backend == nil {
+			t.Fatalf("No backend matched for %s", test.url)
+		}
+
+		resp := NewFileResp(backend, unmatched, Request{Url: u}, cfg)
+		defer resp.Close()
+
+		switch resp := resp.(type) {
+		case *ErrorResponse:
+			if test.want != "" {
+				t.Errorf("%s: expected %s to be served, got status %d", test.url, test.want, resp.StatusCode)
+			} else if resp.StatusCode != 51 {
+				t.Errorf("%s: expected status 51, got %d", test.url, resp.StatusCode)
+			}
+		case *StaticResponse:
+			if test.want == "" {
+				t.Errorf("%s: expected not found, got %s", test.url, resp.file.Name())
+			} else if resp.file.Name() != filepath.Join(location, filepath.FromSlash(test.want)) {
+				t.Errorf("%s: expected %s to be served, got %s", test.url, test.want, resp.file.Name())
+			}
+		default:
+			t.Errorf("%s: unexpected response type %T", test.url, resp)
+		}
+	}
+}
+
+func TestOpenConfined(t *testing.T) {
+	root := t.TempDir()
+	location := filepath.Join(root, "location")
+
+	mustWrite := func(name string, content string) {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSymlink := func(target string, name string) {
+		err := os.Symlink(target, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustWrite(filepath.Join(location, "plain.gmi"), "plain")
+	mustWrite(filepath.Join(location, "sub", "inner.gmi"), "inner")
+	mustWrite(filepath.Join(root, "outside.gmi"), "outside")
+	mustSymlink("sub/inner.gmi", filepath.Join(location, "inside-link.gmi"))
+	mustSymlink("sub", filepath.Join(location, "inside-dir"))
+	mustSymlink("../outside.gmi", filepath.Join(location, "outside-link.gmi"))
+	mustSymlink(root, filepath.Join(location, "outside-dir"))
+
+	tests := []struct {
+		name           string
+		followSymlinks string
+		want           string // empty if opening should fail
+	}{
+		{"plain.gmi", "never", "plain"},
+		{"plain.gmi", "within", "plain"},
+		{"plain.gmi", "always", "plain"},
+		{"sub/inner.gmi", "never", "inner"},
+
+		{"inside-link.gmi", "never", ""},
+		{"inside-link.gmi", "within", "inner"},
+		{"inside-link.gmi", "always", "inner"},
+		{"inside-dir/inner.gmi", "never", ""},
+		{"inside-dir/inner.gmi", "within", "inner"},
+		{"inside-dir/inner.gmi", "always", "inner"},
+
+		{"outside-link.gmi", "never", ""},
+		{"outside-link.gmi", "within", ""},
+		{"outside-link.gmi", "always", "outside"},
+		{"outside-dir/outside.gmi", "never", ""},
+		{"outside-dir/outside.gmi", "within", ""},
+		{"outside-dir/outside.gmi", "always", "outside"},
+		{"outside-dir/location/plain.gmi", "never", ""},
+		{"outside-dir/location/plain.gmi", "within", "plain"},
+
+		{"missing.gmi", "within", ""},
+	}
+
+	for _, test := range tests {
+		backend := &Backend{
+			Location:       location,
+			FollowSymlinks: test.followSymlinks,
+		}
+
+		f, err := openConfined(filepath.Join(location, filepath.FromSlash(test.name)), backend)
+		if test.want == "" {
+			if err == nil {
+				f.Close()
+				t.Errorf("%s (%s): expected an error", test.name, test.followSymlinks)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s (%s): unexpected error: %s", test.name, test.followSymlinks, err)
+			continue
+		}
+
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.want {
+			t.Errorf("%s (%s): expected content %q, got %q", test.name, test.followSymlinks, test.want, content)
+		}
+	}
+}
+
+func TestCheckOpened(t *testing.T) {
+	root := t.TempDir()
+	inside := filepath.Join(root, "location", "sub", "page.gmi")
+	outside := filepath.Join(root, "outside", "page.gmi")
+	for _, name := range []string{inside, outside} {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte("x"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checks := map[string]func(*os.File, string) error{
+		"checkOpened":   checkOpened,
+		"checkSameFile": checkSameFile,
+	}
+	for name, check := range checks {
+		f, err := os.Open(inside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := check(f, inside); err != nil {
+			t.Errorf("%s: unexpected error for the right file: %s", name, err)
+		}
+		f.Close()
+
+		// as if the file was opened after the directory was replaced
+		f, err = os.Open(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := check(f, inside); err == nil {
+			t.Errorf("%s: expected an error for the wrong file", name)
+		}
+		f.Close()
+	}
+
+	// replace the directory with a symlink to the outside one, so that the
+	// resolved path leads to the wrong file.
+	sub := filepath.Dir(inside)
+	err := os.Rename(sub, sub+".old")
+	if err == nil {
+		err = os.Symlink(filepath.Dir(outside), sub)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(inside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for name, check := range checks {
+		if err := check(f, inside); err == nil {
+			t.Errorf("%s: expected an error after the directory was replaced", name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package hodhod
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var userNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+type UserDirError struct {
+	User   string
+	Reason string
+}
+
+func (e UserDirError) Error() string {
+	return fmt.Sprintf("Cannot serve directory of user '%s': %s", e.User, e.Reason)
+}
+
+func errUserDir(userName string, reason string) UserDirError {
+	return UserDirError{
+		User:   userName,
+		Reason: reason,
+	}
+}
+
+// Splits the unmatched part of a userdir request path (e.g. "~alice/foo/bar")
+// into the user name and the path inside the user directory. The user name
+// must come right after a tilde, which is either at the start of the unmatched
+// part, or right before it in the request path (e.g. when the route prefix is
+// "gemini://example.org/~"); returns false otherwise.
+func splitUserDirPath(unmatched string, requestPath string) (userName string, rest string, ok bool) {
+	unmatched, ok = strings.CutPrefix(unmatched, "~")
+	if !ok {
+		// ignore the trailing slash, which might have been added or removed
+		// when matching the route.
+		requestPath = strings.TrimSuffix(requestPath, "/")
+		matched, found := strings.CutSuffix(requestPath, strings.TrimSuffix(unmatched, "/"))
+		ok = found && unmatched != "" && strings.HasSuffix(matched, "~")
+	}
+	if !ok {
+		return
+	}
+
+	userName, rest, _ = strings.Cut(unmatched, "/")
+	return
+}
+
+// Returns the directory serving the capsule of the given user, after making
+// sure the user is allowed to have one and that they own it.
+func getUserDir(backend *Backend, userName string) (dir string, err error) {
+	if !userNameRegexp.MatchString(userName) {
+		err = errUserDir(userName, "invalid user name")
+		return
+	}
+
+	if len(backend.AllowedUsers) > 0 {
+		allowed := false
+		for _, u := range backend.AllowedUsers {
+			if u == userName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			err = errUserDir(userName, "user not allowed")
+			return
+		}
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return
+	}
+
+	dir = strings.ReplaceAll(backend.Location, "{user}", userName)
+	dir = strings.ReplaceAll(dir, "{home}", u.HomeDir)
+	dir = filepath.Clean(dir)
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+
+	if !info.IsDir() {
+		err = errUserDir(userName, "not a directory")
+		return
+	}
+
+	uid, ok := fileOwner(info)
+	if !ok || uid != u.Uid {
+		err = errUserDir(userName, "directory not owned by user")
+		return
+	}
+
+	return
+}
+
+// returned by userDirBackend if there is no user name in the request path
+var errNoUserName = errors.New("No user name in request path.")
+
+// Returns a backend serving the directory of the user a request is for, with
+// the given userdir backend's options, along with the part of the request path
+// inside that directory.
+func userDirBackend(backend *Backend, unmatched string, req *Request) (userBackend Backend, rest string, err error) {
+	userName, rest, ok := splitUserDirPath(unmatched, req.Url.Path)
+	if !ok {
+		err = errNoUserName
+		return
+	}
+
+	dir, err := getUserDir(backend, userName)
+	if err != nil {
+		return
+	}
+
+	userBackend = *backend
+	userBackend.Location = dir
+
+	// user scripts are never run with root privileges; if we have them, the
+	// scripts are run as the user they belong to. config validation makes
+	// sure that we do, if user is not set.
+	if os.Geteuid() == 0 && userBackend.User == "" {
+		userBackend.User = userName
+	}
+
+	return
+}
+
+func NewUserDirResp(backend *Backend, unmatched string, req Request, cfg *Config) (resp Response) {
+	notFound := &ErrorResponse{
+		StatusCode: 51,
+		Meta:       "Not Found",
+	}
+
+	// from here on, the user directory is served just like a static (or
+	// cgi_dir, if cgi is enabled) backend with the user directory as its
+	// location.
+	userBackend, rest, err := userDirBackend(backend, unmatched, &req)
+	if err == errNoUserName {
+		return notFound
+	} else if err != nil {
+		log.Println(err)
+		return notFound
+	}
+
+	if backend.Cgi {
+		return NewCgiDirResp(&userBackend, rest, req, cfg)
+	}
+
+	return NewFileResp(&userBackend, rest, req, cfg)
+}
+
+var _ error = (*UserDirError)(nil)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	"git.sr.ht/~elektito/hodhod/pkg/hodhod"
+)
+
+// Runs the route subcommand, which prints how a URL is routed by a config file,
+// without starting the server.
+func runRoute(args []string) {
+	flags := flag.NewFlagSet("route", flag.ExitOnError)
+	configFile := flags.String("config", "config.json", "Path to config file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hodhod route [-config file] url")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := hodhod.LoadConfig(*configFile)
+	if err != nil {
+		fail("loading config", err)
+	}
+
+	u, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		fail("parsing url", err)
+	}
+	if u.Scheme != "gemini" {
+		fail("parsing url", fmt.Errorf("Invalid URL scheme (%s)", u.Scheme))
+	}
+
+	normalized := cfg.NormalizeUrl(*u)
+	fmt.Println("URL:       ", u.String())
+	fmt.Println("Normalized:", normalized.String())
+
+	route, backend, unmatched := cfg.MatchRoute(*u)
+	if route == nil {
+		fmt.Println("Route:      none; the request gets a 51 response")
+		os.Exit(1)
+	}
+
+	for i := range cfg.Routes {
+		if &cfg.Routes[i] == route {
+			fmt.Printf("Route:      %d (%s)\n", i+1, route.Pattern())
+		}
+	}
+	fmt.Printf("Backend:    %s (%s)\n", backend.Name, backend.Type)
+	fmt.Printf("Unmatched:  %q\n", unmatched)
+
+	switch backend.Type {
+	case "static", "cgi_dir", "userdir":
+		target, err := hodhod.ExplainFileRequest(backend, unmatched, hodhod.Request{Url: u}, &cfg)
+		printFileTarget(target, err)
+	case "cgi":
+		fmt.Println("Script:    ", backend.Script)
+	}
+
+	os.Exit(0)
+}
+
+// Prints how a request to a static, cgi_dir or userdir backend is handled.
+func printFileTarget(target hodhod.FileTarget, err error) {
+	if target.UserDir != "" {
+		fmt.Println("User dir:  ", target.UserDir)
+	}
+
+	if target.Script != nil {
+		fmt.Println("Script:    ", target.Script.Path)
+		fmt.Printf("Path info:  %q\n", target.Script.PathInfo)
+		return
+	}
+
+	rule := target.Rule
+	hasStatus := rule != nil && rule.StatusCode != 0
+	switch {
+	case target.Filename == "" && !hasStatus:
+		fmt.Println("File:       none; the request gets a 51 response:", err)
+	case target.Filename == "":
+		fmt.Println("File:       none")
+	case target.IsDir:
+		fmt.Println("File:      ", target.Filename, "(directory index)")
+	default:
+		fmt.Println("File:      ", target.Filename)
+	}
+
+	if hasStatus {
+		fmt.Printf("Meta rule:  %s; the request gets a %d response (%s)\n", rule.Glob, rule.StatusCode, rule.Meta)
+	} else if target.Redirect != "" {
+		fmt.Println("Redirect:  ", target.Redirect, "(31)")
+	}
+}